@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/scottweston/powerline-shell-go/powerline"
+	"github.com/scottweston/powerline-shell-go/powerline-config"
+)
+
+// how long the daemon lets git or hg run, the prompt doesn't wait for it
+const daemonProbeTimeout = time.Minute
+
+// how many repositories are cached, the least recently asked about go first
+const daemonMaxEntries = 64
+
+// how long a repository that couldn't be cached is left alone, doubling
+// after each failure up to daemonMaxRetry
+const (
+	daemonRetry    = 10 * time.Second
+	daemonMaxRetry = 10 * time.Minute
+)
+
+var errNoDaemon = errors.New("no answer from the daemon")
+
+type daemonRequest struct {
+	Kind string `json:"kind"`
+	Root string `json:"root"`
+}
+
+// daemonResponse has the cached status, Found is false while the daemon is
+// still finding out
+type daemonResponse struct {
+	Found bool       `json:"found"`
+	Git   *gitStatus `json:"git,omitempty"`
+	Hg    string     `json:"hg,omitempty"`
+}
+
+// daemonSocket is the per user socket the daemon listens on
+func daemonSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "powerline-shell-go.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("powerline-shell-go-%d.sock", os.Getuid()))
+}
+
+// askDaemon asks a running daemon about the repository, giving up after
+// daemonTimeout seconds so the caller can probe it directly
+func askDaemon(conf config.Configuration, repo *powerline.Repository) (daemonResponse, error) {
+	var response daemonResponse
+	// the daemon doesn't know our environment
+	if !conf.Daemon || os.Getenv("GIT_DIR") != "" {
+		return response, errNoDaemon
+	}
+	socket := daemonSocket()
+	if !socketOwned(socket) {
+		return response, errNoDaemon
+	}
+
+	timeout := time.Duration(conf.DaemonTimeout * float64(time.Second))
+	conn, err := net.DialTimeout("unix", socket, timeout)
+	if err != nil {
+		return response, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(daemonRequest{Kind: repo.Kind, Root: repo.Root}); err != nil {
+		return response, err
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return response, err
+	}
+	if !response.Found {
+		return response, errNoDaemon
+	}
+	return response, nil
+}
+
+// daemonEntry is the cached state of one repository, it's dropped as soon
+// as anything under the watched directories changes. One that failed is kept
+// without watches until retry, so it isn't probed again on every prompt
+type daemonEntry struct {
+	ready   bool
+	watches []int
+	git     gitStatus
+	hg      string
+	used    time.Time
+
+	failed  bool
+	retry   time.Time
+	backoff time.Duration
+}
+
+type daemon struct {
+	conf    config.Configuration
+	watcher *watcher
+
+	mutex   sync.Mutex
+	entries map[string]*daemonEntry
+	// the repositories each watch belongs to, nested ones share directories
+	watches map[int]map[string]bool
+}
+
+func newDaemon(conf config.Configuration) (*daemon, error) {
+	w, err := newWatcher()
+	if err != nil {
+		return nil, err
+	}
+	d := &daemon{conf: conf, watcher: w, entries: map[string]*daemonEntry{}, watches: map[int]map[string]bool{}}
+	go func() {
+		for wd := range w.events {
+			d.changed(wd)
+		}
+	}()
+	return d, nil
+}
+
+// runDaemon serves the cache on the per user socket until interrupted
+func runDaemon(conf config.Configuration) error {
+	d, err := newDaemon(conf)
+	if err != nil {
+		return err
+	}
+
+	socket := daemonSocket()
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("already running on %s", socket)
+	}
+	// left over from a daemon that didn't exit cleanly
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	err = d.serve(listener)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (d *daemon) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(time.Second))
+			var request daemonRequest
+			if err := json.NewDecoder(conn).Decode(&request); err != nil {
+				return
+			}
+			json.NewEncoder(conn).Encode(d.lookup(request))
+		}()
+	}
+}
+
+// lookup answers from the cache straight away, on a miss the repository is
+// watched and probed in the background for next time
+func (d *daemon) lookup(request daemonRequest) daemonResponse {
+	if request.Kind != "git" && request.Kind != "hg" || !filepath.IsAbs(request.Root) {
+		return daemonResponse{}
+	}
+	key := request.Kind + ":" + request.Root
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	now := time.Now()
+	if entry, found := d.entries[key]; found {
+		entry.used = now
+		if entry.failed && now.After(entry.retry) {
+			entry.failed = false
+			go d.probe(key, entry, request)
+			return daemonResponse{}
+		}
+		if !entry.ready {
+			return daemonResponse{}
+		}
+		if request.Kind == "git" {
+			status := entry.git
+			return daemonResponse{Found: true, Git: &status}
+		}
+		return daemonResponse{Found: true, Hg: entry.hg}
+	}
+
+	if len(d.entries) >= daemonMaxEntries {
+		d.evict()
+	}
+	entry := &daemonEntry{used: now}
+	d.entries[key] = entry
+	go d.probe(key, entry, request)
+	return daemonResponse{}
+}
+
+// evict drops the least recently used entry, called with the mutex held
+func (d *daemon) evict() {
+	var oldest string
+	for key, entry := range d.entries {
+		if oldest == "" || entry.used.Before(d.entries[oldest].used) {
+			oldest = key
+		}
+	}
+	d.drop(oldest, d.entries[oldest])
+}
+
+// probe watches the repository before reading its status, so a change made
+// meanwhile can't leave a stale entry behind
+func (d *daemon) probe(key string, entry *daemonEntry, request daemonRequest) {
+	if err := d.watch(key, entry, request); err != nil {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.fail(key, entry, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), daemonProbeTimeout)
+	defer cancel()
+	var status gitStatus
+	var hg string
+	var err error
+	if request.Kind == "git" {
+		status, err = readGitStatus(ctx, d.conf, request.Root)
+		if err == nil && status.Stale {
+			err = ctx.Err()
+		}
+	} else {
+		hg = readHgSummary(ctx, request.Root)
+		if hg == "" {
+			err = errors.New("hg summary failed")
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	// invalidated while probing
+	if d.entries[key] != entry {
+		return
+	}
+	if err != nil {
+		d.fail(key, entry, err)
+		return
+	}
+	entry.git = status
+	entry.hg = hg
+	entry.ready = true
+	entry.backoff = 0
+}
+
+// fail keeps the entry as a reminder not to try again until its retry time,
+// called with the mutex held
+func (d *daemon) fail(key string, entry *daemonEntry, err error) {
+	if d.entries[key] != entry {
+		return
+	}
+	d.unwatch(key, entry)
+	if entry.backoff == 0 {
+		log.Printf("not caching %s: %s", key, err)
+		entry.backoff = daemonRetry
+	} else if entry.backoff *= 2; entry.backoff > daemonMaxRetry {
+		entry.backoff = daemonMaxRetry
+	}
+	entry.ready = false
+	entry.failed = true
+	entry.retry = time.Now().Add(entry.backoff)
+}
+
+// watch adds the work tree and the repository's own files to the watcher
+func (d *daemon) watch(key string, entry *daemonEntry, request daemonRequest) error {
+	var dirs []string
+	var ignored map[string]bool
+	walk := func(root string, skip ...string) error {
+		return filepath.WalkDir(root, func(path string, info fs.DirEntry, err error) error {
+			if err != nil {
+				// vanished or unreadable, either way not ours to report
+				return nil
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			for _, name := range skip {
+				if path != root && info.Name() == name {
+					return filepath.SkipDir
+				}
+			}
+			if ignored[path] {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+			return nil
+		})
+	}
+
+	if request.Kind == "git" {
+		repo, err := findGitRepo(request.Root)
+		if err != nil {
+			return err
+		}
+		repo.close()
+		if repo.workTree != "" {
+			ignored = ignoredDirs(repo.workTree)
+			walk(repo.workTree, ".git")
+			ignored = nil
+		}
+		// objects only change along with a ref, the logs with them
+		walk(repo.gitDir, "objects", "logs", "modules", "worktrees")
+		if repo.commonDir != repo.gitDir {
+			walk(repo.commonDir, "objects", "logs", "modules", "worktrees")
+		}
+	} else {
+		walk(request.Root, ".hg")
+		dirs = append(dirs, filepath.Join(request.Root, ".hg"), filepath.Join(request.Root, ".hg", "store"))
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.entries[key] != entry {
+		return nil
+	}
+	for _, dir := range dirs {
+		wd, err := d.watcher.add(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if d.watches[wd] == nil {
+			d.watches[wd] = map[string]bool{}
+		}
+		d.watches[wd][key] = true
+		entry.watches = append(entry.watches, wd)
+	}
+	return nil
+}
+
+// ignoredDirs are the directories of the work tree git ignores, whatever
+// happens in them doesn't change the status. Nothing is when git can't say
+func ignoredDirs(workTree string) map[string]bool {
+	ctx, cancel := context.WithTimeout(context.Background(), daemonProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-files", "-z", "--others", "--ignored", "--exclude-standard", "--directory")
+	cmd.Dir = workTree
+	cmd.Env = append(os.Environ(), "GIT_OPTIONAL_LOCKS=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	ignored := map[string]bool{}
+	for _, path := range strings.Split(string(out), "\x00") {
+		if strings.HasSuffix(path, "/") {
+			ignored[filepath.Join(workTree, filepath.FromSlash(path))] = true
+		}
+	}
+	return ignored
+}
+
+// changed drops the repositories with something under wd, -1 when the
+// watcher lost track of events
+func (d *daemon) changed(wd int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if wd < 0 {
+		for key, entry := range d.entries {
+			// those that failed have nothing to lose track of
+			if !entry.failed {
+				d.drop(key, entry)
+			}
+		}
+		return
+	}
+	for key := range d.watches[wd] {
+		d.drop(key, d.entries[key])
+	}
+}
+
+// drop forgets an entry and its watches, called with the mutex held
+func (d *daemon) drop(key string, entry *daemonEntry) {
+	delete(d.entries, key)
+	if entry != nil {
+		d.unwatch(key, entry)
+	}
+}
+
+// unwatch removes the entry's watches that no other entry shares
+func (d *daemon) unwatch(key string, entry *daemonEntry) {
+	for _, wd := range entry.watches {
+		delete(d.watches[wd], key)
+		if len(d.watches[wd]) == 0 {
+			delete(d.watches, wd)
+			d.watcher.remove(wd)
+		}
+	}
+	entry.watches = nil
+}
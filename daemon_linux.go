@@ -0,0 +1,74 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watcher reports the watch descriptors of directories with changes, using
+// inotify
+type watcher struct {
+	fd     int
+	events chan int
+}
+
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+func newWatcher() (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{fd: fd, events: make(chan int, 64)}
+	go w.read()
+	return w, nil
+}
+
+func (w *watcher) add(dir string) (int, error) {
+	return unix.InotifyAddWatch(w.fd, dir, watchMask|unix.IN_ONLYDIR|unix.IN_DONT_FOLLOW|unix.IN_EXCL_UNLINK)
+}
+
+func (w *watcher) remove(wd int) {
+	unix.InotifyRmWatch(w.fd, uint32(wd))
+}
+
+func (w *watcher) read() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil || n <= 0 {
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			switch {
+			case event.Mask&unix.IN_Q_OVERFLOW != 0:
+				w.events <- -1
+			case event.Mask&unix.IN_IGNORED != 0:
+				// the watch is gone, it was removed or its directory was
+			default:
+				w.events <- int(event.Wd)
+			}
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+		}
+	}
+}
+
+// socketOwned makes sure nobody else put the socket there
+func socketOwned(socket string) bool {
+	info, err := os.Lstat(socket)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == os.Getuid()
+}
@@ -0,0 +1,27 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// watcher needs inotify, so the daemon is only available on linux
+type watcher struct {
+	events chan int
+}
+
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("the daemon needs inotify, which is linux only")
+}
+
+func (w *watcher) add(dir string) (int, error) {
+	return 0, errors.New("not supported")
+}
+
+func (w *watcher) remove(wd int) {
+}
+
+func socketOwned(socket string) bool {
+	return false
+}
@@ -0,0 +1,1222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"container/heap"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An in-process reader for the parts of a git repository the prompt needs,
+// so git doesn't have to be forked (or even installed). It understands loose
+// and packed refs, loose objects, version 2 pack indexes and index versions
+// 2 to 4. Untracked files are not reported and renames aren't detected.
+// Files whose stat data changed are hashed as they are on disk, without
+// clean filters or line ending conversion, so files that only differ
+// because of those count as modified. SHA-256 repositories and split
+// indexes aren't supported.
+
+var errNotGitRepository = errors.New("not a git repository")
+
+// errNativeUnsupported is returned for repositories only git can read
+var errNativeUnsupported = errors.New("repository format not supported natively")
+
+type gitHash [20]byte
+
+func parseGitHash(s string) (gitHash, error) {
+	var h gitHash
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != len(h) {
+		return h, fmt.Errorf("invalid object name %q", s)
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+func (h gitHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+type gitRepo struct {
+	workTree  string // empty for bare repositories or inside the git dir
+	gitDir    string
+	commonDir string
+	packs     []*gitPack
+	loaded    bool
+	// whether changes in submodules count
+	submodules bool
+	// cancels long running reads, may be nil
+	ctx context.Context
+}
+
+// cancelled returns the context's error once it's been cancelled or its
+// deadline has passed
+func (r *gitRepo) cancelled() error {
+	if r.ctx == nil {
+		return nil
+	}
+	return r.ctx.Err()
+}
+
+// findGitRepo walks up from dir looking for a .git directory or file,
+// $GIT_DIR and $GIT_WORK_TREE take precedence
+func findGitRepo(dir string) (*gitRepo, error) {
+	if gitDir := os.Getenv("GIT_DIR"); gitDir != "" {
+		workTree := os.Getenv("GIT_WORK_TREE")
+		if workTree == "" {
+			workTree = dir
+		}
+		return newGitRepo(workTree, gitDir)
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	ceilings := gitCeilings()
+	for {
+		// inside a bare repository or the .git dir itself
+		if isGitDir(dir) {
+			return newGitRepo("", dir)
+		}
+		dotGit := filepath.Join(dir, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			if info.IsDir() {
+				return newGitRepo(dir, dotGit)
+			}
+			// worktrees and submodules point at their real git dir
+			data, err := ioutil.ReadFile(dotGit)
+			if err != nil {
+				return nil, err
+			}
+			line := strings.TrimSpace(string(data))
+			if !strings.HasPrefix(line, "gitdir: ") {
+				return nil, fmt.Errorf("invalid gitfile %s", dotGit)
+			}
+			gitDir := strings.TrimPrefix(line, "gitdir: ")
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return newGitRepo(dir, gitDir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir || isCeiling(parent, ceilings) {
+			return nil, errNotGitRepository
+		}
+		dir = parent
+	}
+}
+
+func isGitDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		return false
+	}
+	for _, name := range []string{"objects", "commondir"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func newGitRepo(workTree string, gitDir string) (*gitRepo, error) {
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); err != nil {
+		return nil, errNotGitRepository
+	}
+	repo := gitRepo{workTree: workTree, gitDir: gitDir, commonDir: gitDir}
+	if data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir := strings.TrimSpace(string(data))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+		repo.commonDir = commonDir
+	}
+	return &repo, nil
+}
+
+// Refs
+
+// head returns the branch HEAD points at (empty when detached) and the
+// commit it resolves to (nil when there are no commits yet)
+func (r *gitRepo) head() (string, *gitHash, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.gitDir, "HEAD"))
+	if err != nil {
+		return "", nil, err
+	}
+	line := strings.TrimSpace(string(data))
+	if strings.HasPrefix(line, "ref: ") {
+		ref := strings.TrimPrefix(line, "ref: ")
+		hash, err := r.resolveRef(ref)
+		if err != nil {
+			return strings.TrimPrefix(ref, "refs/heads/"), nil, nil
+		}
+		return strings.TrimPrefix(ref, "refs/heads/"), &hash, nil
+	}
+	hash, err := parseGitHash(line)
+	if err != nil {
+		return "", nil, err
+	}
+	return "", &hash, nil
+}
+
+func (r *gitRepo) resolveRef(ref string) (gitHash, error) {
+	for depth := 0; depth < 5; depth++ {
+		data, err := ioutil.ReadFile(filepath.Join(r.commonDir, filepath.FromSlash(ref)))
+		if err != nil {
+			return r.packedRef(ref)
+		}
+		line := strings.TrimSpace(string(data))
+		if !strings.HasPrefix(line, "ref: ") {
+			return parseGitHash(line)
+		}
+		ref = strings.TrimPrefix(line, "ref: ")
+	}
+	return gitHash{}, fmt.Errorf("too many levels of symbolic refs")
+}
+
+func (r *gitRepo) packedRef(ref string) (gitHash, error) {
+	file, err := os.Open(filepath.Join(r.commonDir, "packed-refs"))
+	if err != nil {
+		return gitHash{}, fmt.Errorf("unknown ref %s", ref)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return parseGitHash(fields[0])
+		}
+	}
+	return gitHash{}, fmt.Errorf("unknown ref %s", ref)
+}
+
+// tagAt returns the name of a tag pointing at the commit hash like
+// `git describe --tags --exact-match`, annotated tags are preferred over
+// lightweight ones and otherwise the first by name wins
+func (r *gitRepo) tagAt(hash gitHash) string {
+	// tag name to whether it's annotated, loose tags override packed ones
+	tags := map[string]bool{}
+
+	if file, err := os.Open(filepath.Join(r.commonDir, "packed-refs")); err == nil {
+		name := ""
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "^") {
+				// the peeled commit of the annotated tag on the line before
+				if peeled, err := parseGitHash(line[1:]); err == nil && peeled == hash && name != "" {
+					tags[name] = true
+				}
+				continue
+			}
+			name = ""
+			fields := strings.Fields(line)
+			if len(fields) == 2 && strings.HasPrefix(fields[1], "refs/tags/") {
+				name = strings.TrimPrefix(fields[1], "refs/tags/")
+				if target, err := parseGitHash(fields[0]); err == nil && target == hash {
+					tags[name] = false
+				}
+			}
+		}
+		file.Close()
+	}
+
+	root := filepath.Join(r.commonDir, "refs", "tags")
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name, _ := filepath.Rel(root, path)
+		name = filepath.ToSlash(name)
+		delete(tags, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		target, err := parseGitHash(string(data))
+		if err != nil {
+			return nil
+		}
+		if target == hash {
+			tags[name] = false
+			return nil
+		}
+		// peel annotated tags, which may point at other tags
+		for depth := 0; depth < 5; depth++ {
+			kind, data, err := r.readObject(target)
+			if err != nil || kind != "tag" {
+				return nil
+			}
+			line := strings.SplitN(string(data), "\n", 2)[0]
+			if !strings.HasPrefix(line, "object ") {
+				return nil
+			}
+			if target, err = parseGitHash(strings.TrimPrefix(line, "object ")); err != nil {
+				return nil
+			}
+			if target == hash {
+				tags[name] = true
+				return nil
+			}
+		}
+		return nil
+	})
+
+	var names []string
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if tags[names[i]] != tags[names[j]] {
+			return tags[names[i]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// config returns the value of key (e.g. `branch "main".remote`) from the
+// repository configuration
+func (r *gitRepo) config(section string, key string) string {
+	file, err := os.Open(filepath.Join(r.commonDir, "config"))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	current := ""
+	value := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			current = strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			continue
+		}
+		if current != section {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), key) {
+			value = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		}
+	}
+	return value
+}
+
+// upstream returns the short name and full ref of the branch's upstream
+func (r *gitRepo) upstream(branch string) (string, string) {
+	section := fmt.Sprintf("branch %q", branch)
+	remote := r.config(section, "remote")
+	merge := r.config(section, "merge")
+	if remote == "" || merge == "" {
+		return "", ""
+	}
+	name := strings.TrimPrefix(merge, "refs/heads/")
+	if remote == "." {
+		return name, merge
+	}
+	return remote + "/" + name, "refs/remotes/" + remote + "/" + name
+}
+
+// remoteHead returns the default branch of branch's remote (or origin) as
+// recorded by clone or `git remote set-head` in refs/remotes/<remote>/HEAD
+func (r *gitRepo) remoteHead(branch string) string {
+	remote := ""
+	if branch != "" {
+		remote = r.config(fmt.Sprintf("branch %q", branch), "remote")
+	}
+	if remote == "" || remote == "." {
+		remote = "origin"
+	}
+	data, err := ioutil.ReadFile(filepath.Join(r.commonDir, "refs", "remotes", remote, "HEAD"))
+	if err != nil {
+		return ""
+	}
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "ref: ") {
+		return ""
+	}
+	return strings.TrimPrefix(line, "ref: refs/remotes/"+remote+"/")
+}
+
+// Objects
+
+func (r *gitRepo) readObject(hash gitHash) (string, []byte, error) {
+	return r.readObjectDepth(hash, 0)
+}
+
+// longer delta chains than git itself would write mean a corrupt pack
+const maxDeltaDepth = 4096
+
+// readObjectDepth reads an object that's the base of depth deltas
+func (r *gitRepo) readObjectDepth(hash gitHash, depth int) (string, []byte, error) {
+	name := hash.String()
+	if file, err := os.Open(filepath.Join(r.commonDir, "objects", name[:2], name[2:])); err == nil {
+		defer file.Close()
+		zr, err := zlib.NewReader(file)
+		if err != nil {
+			return "", nil, err
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return "", nil, err
+		}
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 {
+			return "", nil, fmt.Errorf("corrupt object %s", name)
+		}
+		kind := strings.SplitN(string(data[:nul]), " ", 2)[0]
+		return kind, data[nul+1:], nil
+	}
+
+	if err := r.loadPacks(); err != nil {
+		return "", nil, err
+	}
+	for _, pack := range r.packs {
+		if offset, found := pack.find(hash); found {
+			kind, data, err := pack.readAt(r, offset, depth)
+			if err != nil {
+				return "", nil, err
+			}
+			return packKinds[kind], data, nil
+		}
+	}
+	return "", nil, fmt.Errorf("object %s not found", name)
+}
+
+type gitCommit struct {
+	tree    gitHash
+	parents []gitHash
+	time    int64
+}
+
+func (r *gitRepo) readCommit(hash gitHash) (*gitCommit, error) {
+	kind, data, err := r.readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if kind != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", hash, kind)
+	}
+
+	var commit gitCommit
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "tree ") {
+			tree, err := parseGitHash(strings.TrimPrefix(line, "tree "))
+			if err != nil {
+				return nil, err
+			}
+			commit.tree = tree
+		} else if strings.HasPrefix(line, "parent ") {
+			parent, err := parseGitHash(strings.TrimPrefix(line, "parent "))
+			if err != nil {
+				return nil, err
+			}
+			commit.parents = append(commit.parents, parent)
+		} else if strings.HasPrefix(line, "committer ") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				commit.time, _ = strconv.ParseInt(fields[len(fields)-2], 10, 64)
+			}
+		}
+	}
+	return &commit, nil
+}
+
+// Packs
+
+var packKinds = map[int]string{1: "commit", 2: "tree", 3: "blob", 4: "tag"}
+
+const (
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+type gitPack struct {
+	idx   *os.File
+	pack  *os.File
+	count uint32
+	cache map[int64]packObject
+}
+
+type packObject struct {
+	kind int
+	data []byte
+}
+
+func (r *gitRepo) loadPacks() error {
+	if r.loaded {
+		return nil
+	}
+	r.loaded = true
+
+	indexes, err := filepath.Glob(filepath.Join(r.commonDir, "objects", "pack", "*.idx"))
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		pack, err := openGitPack(index)
+		if err != nil {
+			return err
+		}
+		r.packs = append(r.packs, pack)
+	}
+	return nil
+}
+
+func (r *gitRepo) close() {
+	for _, pack := range r.packs {
+		pack.idx.Close()
+		pack.pack.Close()
+	}
+}
+
+func openGitPack(index string) (*gitPack, error) {
+	idx, err := os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 8+256*4)
+	if _, err := idx.ReadAt(header, 0); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}) {
+		idx.Close()
+		return nil, fmt.Errorf("unsupported pack index %s", index)
+	}
+	pack, err := os.Open(strings.TrimSuffix(index, ".idx") + ".pack")
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return &gitPack{
+		idx:   idx,
+		pack:  pack,
+		count: binary.BigEndian.Uint32(header[8+255*4:]),
+		cache: map[int64]packObject{},
+	}, nil
+}
+
+func (p *gitPack) uint32At(offset int64) uint32 {
+	var buf [4]byte
+	if _, err := p.idx.ReadAt(buf[:], offset); err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(buf[:])
+}
+
+// find binary searches the index for hash and returns its offset in the pack
+func (p *gitPack) find(hash gitHash) (int64, bool) {
+	const fanout = 8
+	const names = fanout + 256*4
+
+	lo := uint32(0)
+	if hash[0] > 0 {
+		lo = p.uint32At(fanout + int64(hash[0]-1)*4)
+	}
+	hi := p.uint32At(fanout + int64(hash[0])*4)
+
+	var name gitHash
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if _, err := p.idx.ReadAt(name[:], names+int64(mid)*20); err != nil {
+			return 0, false
+		}
+		switch bytes.Compare(name[:], hash[:]) {
+		case 0:
+			offsets := int64(names) + int64(p.count)*24
+			offset := p.uint32At(offsets + int64(mid)*4)
+			if offset&0x80000000 == 0 {
+				return int64(offset), true
+			}
+			var buf [8]byte
+			large := offsets + int64(p.count)*4 + int64(offset&0x7fffffff)*8
+			if _, err := p.idx.ReadAt(buf[:], large); err != nil {
+				return 0, false
+			}
+			return int64(binary.BigEndian.Uint64(buf[:])), true
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+func (p *gitPack) readAt(r *gitRepo, offset int64, depth int) (int, []byte, error) {
+	if object, found := p.cache[offset]; found {
+		return object.kind, object.data, nil
+	}
+	if depth > maxDeltaDepth {
+		return 0, nil, errors.New("delta chain too long")
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(p.pack, offset, 1<<62))
+	c, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	kind := int(c>>4) & 7
+	for c&0x80 != 0 {
+		if c, err = reader.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var base packObject
+	switch kind {
+	case packOfsDelta:
+		c, err = reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		distance := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = reader.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			distance = (distance+1)<<7 | int64(c&0x7f)
+		}
+		// the base comes earlier in the pack, after its header
+		if distance <= 0 || distance >= offset {
+			return 0, nil, fmt.Errorf("bad delta base offset at %d", offset)
+		}
+		if base.kind, base.data, err = p.readAt(r, offset-distance, depth+1); err != nil {
+			return 0, nil, err
+		}
+	case packRefDelta:
+		var hash gitHash
+		if _, err := io.ReadFull(reader, hash[:]); err != nil {
+			return 0, nil, err
+		}
+		var name string
+		if name, base.data, err = r.readObjectDepth(hash, depth+1); err != nil {
+			return 0, nil, err
+		}
+		for k, v := range packKinds {
+			if v == name {
+				base.kind = k
+			}
+		}
+	}
+
+	zr, err := zlib.NewReader(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if kind == packOfsDelta || kind == packRefDelta {
+		if data, err = applyDelta(base.data, data); err != nil {
+			return 0, nil, err
+		}
+		kind = base.kind
+	}
+
+	p.cache[offset] = packObject{kind, data}
+	return kind, data, nil
+}
+
+func deltaSize(delta []byte) (int, []byte) {
+	size, shift := 0, uint(0)
+	for len(delta) > 0 {
+		c := delta[0]
+		delta = delta[1:]
+		size |= int(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	return size, delta
+}
+
+func applyDelta(base []byte, delta []byte) ([]byte, error) {
+	_, delta = deltaSize(delta)
+	size, delta := deltaSize(delta)
+	out := make([]byte, 0, size)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 == 0 {
+			// insert the next op bytes
+			n := int(op)
+			if n == 0 || n > len(delta) {
+				return nil, errors.New("corrupt delta")
+			}
+			out = append(out, delta[:n]...)
+			delta = delta[n:]
+			continue
+		}
+
+		// copy from the base, offset and size bytes are flagged by op
+		var offset, length int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, errors.New("corrupt delta")
+			}
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				length |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if length == 0 {
+			length = 0x10000
+		}
+		if offset+length > len(base) {
+			return nil, errors.New("corrupt delta")
+		}
+		out = append(out, base[offset:offset+length]...)
+	}
+
+	if len(out) != size {
+		return nil, errors.New("corrupt delta")
+	}
+	return out, nil
+}
+
+// Ahead/behind
+
+const (
+	walkLeft = 1 << iota
+	walkRight
+)
+
+type walkItem struct {
+	hash gitHash
+	time int64
+}
+
+type walkQueue []walkItem
+
+func (q walkQueue) Len() int            { return len(q) }
+func (q walkQueue) Less(i, j int) bool  { return q[i].time > q[j].time }
+func (q walkQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *walkQueue) Push(x interface{}) { *q = append(*q, x.(walkItem)) }
+func (q *walkQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// aheadBehind counts the commits only reachable from local and only
+// reachable from upstream. Commits are walked newest first, painting each
+// with the side(s) it's reachable from, until every commit left to visit is
+// reachable from both
+func (r *gitRepo) aheadBehind(local gitHash, upstream gitHash) (int, int, error) {
+	flags := map[gitHash]int{}
+	commits := map[gitHash]*gitCommit{}
+	queue := &walkQueue{}
+	queued := map[gitHash]bool{}
+	// queued commits not yet known to be reachable from both sides
+	interesting := 0
+
+	push := func(hash gitHash, flag int) error {
+		commit, found := commits[hash]
+		if !found {
+			var err error
+			if commit, err = r.readCommit(hash); err != nil {
+				return err
+			}
+			commits[hash] = commit
+		}
+		before := flags[hash]
+		flags[hash] |= flag
+		if queued[hash] {
+			// it'll pass on the new flag when it's visited
+			if before != walkLeft|walkRight && flags[hash] == walkLeft|walkRight {
+				interesting--
+			}
+			return nil
+		}
+		queued[hash] = true
+		if flags[hash] != walkLeft|walkRight {
+			interesting++
+		}
+		heap.Push(queue, walkItem{hash, commit.time})
+		return nil
+	}
+
+	if err := push(local, walkLeft); err != nil {
+		return 0, 0, err
+	}
+	if err := push(upstream, walkRight); err != nil {
+		return 0, 0, err
+	}
+
+	for queue.Len() > 0 && interesting > 0 {
+		if err := r.cancelled(); err != nil {
+			return 0, 0, err
+		}
+		item := heap.Pop(queue).(walkItem)
+		queued[item.hash] = false
+		flag := flags[item.hash]
+		if flag != walkLeft|walkRight {
+			interesting--
+		}
+		for _, parent := range commits[item.hash].parents {
+			if flags[parent]&flag != flag {
+				if err := push(parent, flag); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+
+	ahead, behind := 0, 0
+	for _, flag := range flags {
+		switch flag {
+		case walkLeft:
+			ahead++
+		case walkRight:
+			behind++
+		}
+	}
+	return ahead, behind, nil
+}
+
+// Index
+
+type indexEntry struct {
+	path  string
+	hash  gitHash
+	mtime [2]uint32
+	size  uint32
+	mode  uint32
+	stage int
+	skip  bool
+}
+
+type gitIndex struct {
+	entries []indexEntry
+	// entries changed within the same second as the index was written
+	// can't be trusted by their stat data alone
+	mtime int64
+	// directories (as "" or "dir/sub/") whose tree is known to match the
+	// index, from the cache tree extension
+	cacheTree map[string]gitHash
+}
+
+func (r *gitRepo) readIndex() (*gitIndex, error) {
+	index := gitIndex{cacheTree: map[string]gitHash{}}
+	file := filepath.Join(r.gitDir, "index")
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &index, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(file); err == nil {
+		index.mtime = info.ModTime().Unix()
+	}
+	if len(data) < 12 || string(data[:4]) != "DIRC" {
+		return nil, errors.New("invalid index")
+	}
+	version := binary.BigEndian.Uint32(data[4:])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+
+	pos := 12
+	previous := ""
+	for i := 0; i < count; i++ {
+		start := pos
+		if pos+62 > len(data) {
+			return nil, errors.New("truncated index")
+		}
+		entry := indexEntry{
+			mtime: [2]uint32{binary.BigEndian.Uint32(data[pos+8:]), binary.BigEndian.Uint32(data[pos+12:])},
+			mode:  binary.BigEndian.Uint32(data[pos+24:]),
+			size:  binary.BigEndian.Uint32(data[pos+36:]),
+		}
+		copy(entry.hash[:], data[pos+40:])
+		flags := binary.BigEndian.Uint16(data[pos+60:])
+		entry.stage = int(flags>>12) & 3
+		entry.skip = flags&0x8000 != 0 // assume valid
+		pos += 62
+		if version >= 3 && flags&0x4000 != 0 {
+			if pos+2 > len(data) {
+				return nil, errors.New("truncated index")
+			}
+			extended := binary.BigEndian.Uint16(data[pos:])
+			entry.skip = entry.skip || extended&0x4000 != 0 // skip worktree
+			pos += 2
+		}
+
+		if version == 4 {
+			// the path is prefix compressed against the previous entry
+			strip, n := binary.Uvarint(data[pos:])
+			if n <= 0 || int(strip) > len(previous) {
+				return nil, errors.New("corrupt index")
+			}
+			pos += n
+			end := bytes.IndexByte(data[pos:], 0)
+			if end < 0 {
+				return nil, errors.New("corrupt index")
+			}
+			entry.path = previous[:len(previous)-int(strip)] + string(data[pos:pos+end])
+			pos += end + 1
+		} else {
+			end := bytes.IndexByte(data[pos:], 0)
+			if end < 0 {
+				return nil, errors.New("corrupt index")
+			}
+			entry.path = string(data[pos : pos+end])
+			// entries are padded with NULs to a multiple of eight bytes
+			pos = start + (pos-start+end+8)&^7
+		}
+		previous = entry.path
+		index.entries = append(index.entries, entry)
+	}
+
+	// extensions follow the entries, the last 20 bytes are a checksum
+	for pos+8 <= len(data)-20 {
+		signature := string(data[pos : pos+4])
+		size := int(binary.BigEndian.Uint32(data[pos+4:]))
+		pos += 8
+		if pos+size > len(data) {
+			break
+		}
+		switch signature {
+		case "TREE":
+			parseCacheTree(data[pos:pos+size], "", index.cacheTree)
+		case "link":
+			// a split index keeps most entries in a shared file
+			return nil, errNativeUnsupported
+		}
+		pos += size
+	}
+	return &index, nil
+}
+
+// parseCacheTree reads one directory of the cache tree extension and its
+// subdirectories, returning what's left. Invalidated directories (an entry
+// count of -1) don't have a hash and aren't recorded
+func parseCacheTree(data []byte, parent string, tree map[string]gitHash) []byte {
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return nil
+	}
+	path := parent
+	if nul > 0 {
+		path += string(data[:nul]) + "/"
+	}
+	data = data[nul+1:]
+
+	newline := bytes.IndexByte(data, '\n')
+	if newline < 0 {
+		return nil
+	}
+	counts := strings.Fields(string(data[:newline]))
+	data = data[newline+1:]
+	if len(counts) != 2 {
+		return nil
+	}
+	entries, _ := strconv.Atoi(counts[0])
+	subtrees, _ := strconv.Atoi(counts[1])
+	if entries >= 0 {
+		if len(data) < 20 {
+			return nil
+		}
+		var hash gitHash
+		copy(hash[:], data)
+		tree[path] = hash
+		data = data[20:]
+	}
+	for i := 0; i < subtrees && data != nil; i++ {
+		data = parseCacheTree(data, path, tree)
+	}
+	return data
+}
+
+type treeEntry struct {
+	mode uint32
+	hash gitHash
+}
+
+// flattenTree collects the files of tree into files, directories that the
+// cache tree says are unchanged are noted in skipped rather than read
+func (r *gitRepo) flattenTree(tree gitHash, prefix string, index *gitIndex, files map[string]treeEntry, skipped map[string]bool) error {
+	if cached, found := index.cacheTree[prefix]; found && cached == tree {
+		skipped[prefix] = true
+		return nil
+	}
+	if err := r.cancelled(); err != nil {
+		return err
+	}
+	kind, data, err := r.readObject(tree)
+	if err != nil {
+		return err
+	}
+	if kind != "tree" {
+		return fmt.Errorf("%s is a %s, not a tree", tree, kind)
+	}
+
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || nul+21 > len(data) {
+			return fmt.Errorf("corrupt tree %s", tree)
+		}
+		mode, _ := strconv.ParseUint(string(data[:space]), 8, 32)
+		path := prefix + string(data[space+1:nul])
+		var hash gitHash
+		copy(hash[:], data[nul+1:])
+		data = data[nul+21:]
+
+		if mode == 040000 {
+			if err := r.flattenTree(hash, path+"/", index, files, skipped); err != nil {
+				return err
+			}
+		} else {
+			files[path] = treeEntry{uint32(mode), hash}
+		}
+	}
+	return nil
+}
+
+// inSkipped reports whether path is inside one of the skipped directories
+func inSkipped(path string, skipped map[string]bool) bool {
+	if skipped[""] {
+		return true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && skipped[path[:i+1]] {
+			return true
+		}
+	}
+	return false
+}
+
+// stagedChanges compares the index against the tree of HEAD. Renames aren't
+// detected, they're counted as an addition and a deletion
+func (r *gitRepo) stagedChanges(head *gitHash, index *gitIndex, status *gitStatus) error {
+	files := map[string]treeEntry{}
+	skipped := map[string]bool{}
+	if head != nil {
+		commit, err := r.readCommit(*head)
+		if err != nil {
+			return err
+		}
+		if err := r.flattenTree(commit.tree, "", index, files, skipped); err != nil {
+			return err
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, entry := range index.entries {
+		seen[entry.path] = true
+		// conflicts are counted with the work tree
+		if entry.stage != 0 || (entry.mode == 0160000 && !r.submodules) || inSkipped(entry.path, skipped) {
+			continue
+		}
+		file, found := files[entry.path]
+		switch {
+		case !found:
+			status.Added++
+		case file.mode != entry.mode || file.hash != entry.hash:
+			status.StagedModified++
+		}
+	}
+	for path, file := range files {
+		if !seen[path] && (file.mode != 0160000 || r.submodules) {
+			status.StagedDeleted++
+		}
+	}
+	return nil
+}
+
+// worktreeChanges compares the index against the stat data of the work tree,
+// counting conflicted, modified and deleted files
+func (r *gitRepo) worktreeChanges(index *gitIndex, status *gitStatus) error {
+	filemode := !strings.EqualFold(r.config("core", "filemode"), "false")
+	conflicted := map[string]bool{}
+	for _, entry := range index.entries {
+		if err := r.cancelled(); err != nil {
+			return err
+		}
+		if entry.stage != 0 {
+			if !conflicted[entry.path] {
+				conflicted[entry.path] = true
+				status.Conflicted++
+			}
+			continue
+		}
+		if entry.skip {
+			continue
+		}
+		if entry.mode == 0160000 {
+			// a submodule is modified when it has moved on or has changes
+			// of its own, they're ignored like --ignore-submodules otherwise
+			// and one that isn't checked out has no .git, like git it's skipped
+			// rather than finding this repository above it
+			sub := filepath.Join(r.workTree, filepath.FromSlash(entry.path))
+			if _, err := os.Lstat(filepath.Join(sub, ".git")); r.submodules && err == nil {
+				sub, err := nativeGitStatus(r.ctx, sub, true)
+				if err == nil && (sub.Oid != entry.hash.String() || sub.Dirty()) {
+					status.Modified++
+				}
+			}
+			continue
+		}
+		path := filepath.Join(r.workTree, filepath.FromSlash(entry.path))
+		info, err := os.Lstat(path)
+		if err != nil {
+			status.Deleted++
+			continue
+		}
+		if fileMode(info, filemode) != entry.mode || uint32(info.Size()) != entry.size {
+			status.Modified++
+			continue
+		}
+		// like git, when the stat data doesn't match, or is too recent to
+		// be trusted, the contents decide
+		mtime := info.ModTime()
+		if uint32(mtime.Unix()) != entry.mtime[0] || (entry.mtime[1] != 0 && uint32(mtime.Nanosecond()) != entry.mtime[1]) ||
+			mtime.Unix() >= index.mtime {
+			if hash, err := blobHash(path, info); err != nil || hash != entry.hash {
+				status.Modified++
+			}
+		}
+	}
+	return nil
+}
+
+// fileMode is the mode git would record for a file, without core.fileMode
+// only the index knows if it's executable
+func fileMode(info os.FileInfo, filemode bool) uint32 {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return 0120000
+	case filemode && info.Mode()&0111 != 0:
+		return 0100755
+	}
+	return 0100644
+}
+
+// blobHash is the object name the file would have if it were added
+func blobHash(path string, info os.FileInfo) (gitHash, error) {
+	var hash gitHash
+	var data []byte
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return hash, err
+		}
+		data = []byte(filepath.ToSlash(target))
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return hash, err
+		}
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	copy(hash[:], h.Sum(nil))
+	return hash, nil
+}
+
+// headStatus fills in the branch, upstream and repository state, which is
+// all there is to know outside of a work tree
+func (r *gitRepo) headStatus() (gitStatus, *gitHash, error) {
+	var status gitStatus
+
+	branch, head, err := r.head()
+	if err != nil {
+		return status, nil, err
+	}
+	status.Branch = branch
+	status.Detached = branch == ""
+	if head != nil {
+		status.Oid = head.String()
+	}
+
+	if branch != "" {
+		if name, ref := r.upstream(branch); name != "" {
+			status.Upstream = name
+			if upstream, err := r.resolveRef(ref); err == nil && head != nil {
+				status.Ahead, status.Behind, _ = r.aheadBehind(*head, upstream)
+				if err := r.cancelled(); err != nil {
+					return status, nil, err
+				}
+			}
+		}
+	}
+
+	r.state(&status)
+	return status, head, nil
+}
+
+// nativeGitStatus fills in as much of a gitStatus as it can without git,
+// submodules decides whether their changes are counted
+func nativeGitStatus(ctx context.Context, dir string, submodules bool) (gitStatus, error) {
+	repo, err := findGitRepo(dir)
+	if err != nil {
+		return gitStatus{}, err
+	}
+	defer repo.close()
+	repo.submodules = submodules
+	repo.ctx = ctx
+	if strings.EqualFold(repo.config("extensions", "objectformat"), "sha256") {
+		return gitStatus{}, errNativeUnsupported
+	}
+
+	status, head, err := repo.headStatus()
+	if err != nil || repo.workTree == "" {
+		return status, err
+	}
+
+	index, err := repo.readIndex()
+	if err != nil {
+		return status, err
+	}
+	if err := repo.stagedChanges(head, index, &status); err != nil {
+		return status, err
+	}
+	if err := repo.worktreeChanges(index, &status); err != nil {
+		return status, err
+	}
+	return status, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/scottweston/powerline-shell-go/powerline-config"
+)
+
+// gitStatus is what the git segment knows about a repository, filled in from
+// `git status --porcelain=v2` or the native reader
+type gitStatus struct {
+	Branch   string // empty when detached
+	Detached bool
+	Tag      string // a tag pointing at a detached HEAD
+	Oid      string // empty before the first commit
+	Upstream string
+	Primary  string // the remote's default branch, from its HEAD
+	Ahead    int
+	Behind   int
+
+	Submodule string // name of the parent repository
+	Worktree  string // name of a linked worktree
+	GitDir    string // "bare" or "git dir" outside of a work tree
+
+	// changes staged in the index
+	Added          int
+	Renamed        int
+	StagedModified int
+	StagedDeleted  int
+
+	// changes in the work tree
+	Modified   int
+	Deleted    int
+	Untracked  int
+	Conflicted int
+
+	Operation string // e.g. "REBASE 3/7" or "MERGING"
+	Stashed   int
+
+	// only the branch is known, the rest took too long to find out
+	Stale bool
+}
+
+func (self gitStatus) Staged() bool {
+	return self.Added > 0 || self.Renamed > 0 || self.StagedModified > 0 || self.StagedDeleted > 0
+}
+
+func (self gitStatus) Unstaged() bool {
+	return self.Modified > 0 || self.Deleted > 0 || self.Untracked > 0 || self.Conflicted > 0
+}
+
+func (self gitStatus) Dirty() bool {
+	return self.Staged() || self.Unstaged()
+}
+
+// parseGitStatus reads the output of
+// `git status --porcelain=v2 --branch`
+func parseGitStatus(porcelain string) gitStatus {
+	var status gitStatus
+
+	for _, line := range strings.Split(porcelain, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "#":
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "branch.oid":
+				if fields[2] != "(initial)" {
+					status.Oid = fields[2]
+				}
+			case "branch.head":
+				if fields[2] == "(detached)" {
+					status.Detached = true
+				} else {
+					status.Branch = fields[2]
+				}
+			case "branch.upstream":
+				status.Upstream = fields[2]
+			case "branch.ab":
+				status.Ahead, _ = strconv.Atoi(strings.TrimPrefix(fields[2], "+"))
+				if len(fields) > 3 {
+					status.Behind, _ = strconv.Atoi(strings.TrimPrefix(fields[3], "-"))
+				}
+			}
+		case "1", "2":
+			xy := fields[1]
+			if len(xy) != 2 {
+				continue
+			}
+			// X is the index, Y the work tree
+			switch xy[0] {
+			case 'R', 'C':
+				status.Renamed++
+			case 'A':
+				status.Added++
+			case 'M', 'T':
+				status.StagedModified++
+			case 'D':
+				status.StagedDeleted++
+			}
+			switch xy[1] {
+			case 'M', 'T':
+				status.Modified++
+			case 'D':
+				status.Deleted++
+			}
+		case "u":
+			status.Conflicted++
+		case "?":
+			status.Untracked++
+		}
+	}
+	return status
+}
+
+// readGitStatus asks the configured backend about the repository at dir,
+// falling back to the native reader when git isn't installed. When ctx
+// expires first the status only has the branch and is marked stale
+func readGitStatus(ctx context.Context, conf config.Configuration, dir string) (gitStatus, error) {
+	status, err := probeGitStatus(ctx, conf, dir)
+	if err != nil && ctx.Err() != nil {
+		return staleGitStatus(dir)
+	}
+	return status, err
+}
+
+func probeGitStatus(ctx context.Context, conf config.Configuration, dir string) (gitStatus, error) {
+	if conf.GitBackend == "native" {
+		status, err := nativeGitStatus(ctx, dir, conf.SubmodulesDirty)
+		if !errors.Is(err, errNativeUnsupported) {
+			return status, err
+		}
+		// git can still tell us
+	}
+
+	// git status won't run outside of a work tree
+	repo, err := findGitRepo(dir)
+	if err == nil && repo.workTree == "" {
+		defer repo.close()
+		repo.ctx = ctx
+		status, _, err := repo.headStatus()
+		return status, err
+	}
+
+	untracked := true
+	if repo != nil {
+		untracked = scanUntracked(conf, repo.workTree)
+	}
+	status, err := execGitStatus(ctx, dir, conf.SubmodulesDirty, untracked)
+	if err != nil {
+		return status, err
+	}
+	if repo != nil {
+		defer repo.close()
+		repo.state(&status)
+	}
+	return status, nil
+}
+
+func execGitStatus(ctx context.Context, dir string, submodules bool, untracked bool) (gitStatus, error) {
+	args := []string{"status", "--porcelain=v2", "--branch"}
+	if !submodules {
+		args = append(args, "--ignore-submodules")
+	}
+	if !untracked {
+		args = append(args, "--untracked-files=no")
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// refreshing the index would race with the user's own git commands, and
+	// wake up the daemon's watches on it
+	cmd.Env = append(os.Environ(), "GIT_OPTIONAL_LOCKS=0")
+	// children of git, like an fsmonitor hook, can hold on to its output
+	// after it has been killed
+	cmd.WaitDelay = vcsWaitDelay
+	porcelain, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nativeGitStatus(ctx, dir, submodules)
+	} else if err != nil {
+		return gitStatus{}, err
+	}
+	return parseGitStatus(string(porcelain)), nil
+}
+
+// staleGitStatus is what's shown when reading the status took too long, the
+// branch comes from HEAD and everything else is unknown
+func staleGitStatus(dir string) (gitStatus, error) {
+	repo, err := findGitRepo(dir)
+	if err != nil {
+		return gitStatus{}, err
+	}
+	branch, head, err := repo.head()
+	if err != nil {
+		return gitStatus{}, err
+	}
+	status := gitStatus{Branch: branch, Detached: branch == "", Stale: true}
+	if head != nil {
+		status.Oid = head.String()
+	}
+	return status, nil
+}
+
+// scanUntracked reports whether to look for untracked files in the
+// repository at root, the noUntracked option lists (glob) paths not to
+func scanUntracked(conf config.Configuration, root string) bool {
+	home, _ := os.UserHomeDir()
+	for _, pattern := range conf.NoUntracked {
+		if strings.HasPrefix(pattern, "~/") && home != "" {
+			pattern = filepath.Join(home, pattern[2:])
+		}
+		if matched, _ := filepath.Match(filepath.Clean(pattern), root); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// state fills in what git status doesn't tell us
+func (r *gitRepo) state(status *gitStatus) {
+	status.Operation = gitOperation(r.gitDir)
+	status.Primary = r.remoteHead(status.Branch)
+	status.Submodule = r.submoduleOf()
+	status.Worktree = r.worktreeName()
+	if r.workTree == "" {
+		status.GitDir = "git dir"
+		if strings.EqualFold(r.config("core", "bare"), "true") {
+			status.GitDir = "bare"
+		}
+	}
+	status.Stashed = gitStashCount(r.commonDir)
+	if status.Detached && status.Oid != "" {
+		if hash, err := parseGitHash(status.Oid); err == nil {
+			status.Tag = r.tagAt(hash)
+		}
+	}
+}
+
+// gitStashCount counts the entries of refs/stash, which live in its reflog
+func gitStashCount(commonDir string) int {
+	data, err := ioutil.ReadFile(filepath.Join(commonDir, "logs", "refs", "stash"))
+	if err != nil {
+		return 0
+	}
+	return strings.Count(string(data), "\n")
+}
+
+// gitOperation describes the rebase, merge, cherry-pick, revert or bisect in
+// progress in gitDir, if any
+func gitOperation(gitDir string) string {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(gitDir, name))
+		return err == nil
+	}
+	progress := func(dir string, step string, total string) string {
+		a, err_a := ioutil.ReadFile(filepath.Join(gitDir, dir, step))
+		b, err_b := ioutil.ReadFile(filepath.Join(gitDir, dir, total))
+		if err_a != nil || err_b != nil {
+			return ""
+		}
+		return fmt.Sprintf(" %s/%s", strings.TrimSpace(string(a)), strings.TrimSpace(string(b)))
+	}
+
+	switch {
+	case exists("rebase-merge"):
+		return "REBASE" + progress("rebase-merge", "msgnum", "end")
+	case exists("rebase-apply"):
+		if exists("rebase-apply/applying") {
+			return "AM" + progress("rebase-apply", "next", "last")
+		}
+		return "REBASE" + progress("rebase-apply", "next", "last")
+	case exists("MERGE_HEAD"):
+		return "MERGING"
+	case exists("CHERRY_PICK_HEAD"):
+		return "CHERRY-PICKING"
+	case exists("REVERT_HEAD"):
+		return "REVERTING"
+	case exists("BISECT_LOG"):
+		return "BISECTING"
+	}
+	return ""
+}
+
+// submoduleOf returns the name of the repository this is a submodule of.
+// Submodules keep their git dir in the parent's .git/modules
+func (r *gitRepo) submoduleOf() string {
+	if r.workTree == "" {
+		return ""
+	}
+	modules := string(filepath.Separator) + "modules" + string(filepath.Separator)
+	if !strings.Contains(r.commonDir, modules) {
+		return ""
+	}
+	parent, err := findGitRepo(filepath.Dir(r.workTree))
+	if err != nil || parent.workTree == "" {
+		return ""
+	}
+	return filepath.Base(parent.workTree)
+}
+
+// worktreeName returns the name of a linked worktree, their git dirs live
+// in the main repository's .git/worktrees
+func (r *gitRepo) worktreeName() string {
+	if r.gitDir == r.commonDir || filepath.Base(filepath.Dir(r.gitDir)) != "worktrees" {
+		return ""
+	}
+	return filepath.Base(r.gitDir)
+}
@@ -1,5 +1,5 @@
 module github.com/scottweston/powerline-shell-go
 
-go 1.16
+go 1.20
 
 require golang.org/x/sys v0.0.0-20210227040730-b0d1d43c014d
@@ -1,89 +1,177 @@
 package config
 
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/scottweston/powerline-shell-go/powerline"
+)
+
+// BranchRule matches branch names against a glob pattern, e.g. "release/*".
+// Primary branches are shown without the branch icon and a rule may also
+// give its branches their own colours. A plain string in the configuration
+// is a primary branch. Vcs limits the rule to "git" or "hg"
+type BranchRule struct {
+	Pattern    string            `json:"pattern"`
+	Vcs        string            `json:"vcs"`
+	Primary    bool              `json:"primary"`
+	Background *powerline.Colour `json:"background"`
+	Text       *powerline.Colour `json:"text"`
+}
+
+func (self *BranchRule) UnmarshalJSON(data []byte) error {
+	var pattern string
+	if err := json.Unmarshal(data, &pattern); err == nil {
+		*self = BranchRule{Pattern: pattern, Primary: true}
+		return nil
+	}
+	// the slice element may still hold a default rule
+	*self = BranchRule{}
+	type rule BranchRule
+	return json.Unmarshal(data, (*rule)(self))
+}
+
+func (self BranchRule) Matches(vcs string, branch string) bool {
+	if self.Vcs != "" && self.Vcs != vcs {
+		return false
+	}
+	matched, err := path.Match(self.Pattern, branch)
+	return err == nil && matched
+}
+
 type Configuration struct {
-	ShowWritable      bool `json:"showWritable"`
-	ShowVirtualEnv    bool `json:"showVirtualEnv"`
-	ShowCwd           bool `json:"showCwd"`
-	CwdMaxLength      int  `json:"cwdMaxLength"`
-	BranchMaxLength   int  `json:"branchMaxLength"`
-	HostnameMaxLength int  `json:"hostnameMaxLength"`
-	BatteryWarn       int  `json:"batteryWarn"`
-	ShowGit           bool `json:"showGit"`
-	ShowHg            bool `json:"showHg"`
-	ShowReturnCode    bool `json:"showReturnCode"`
-	Icons             struct {
+	ShowWritable        bool         `json:"showWritable"`
+	ShowVirtualEnv      bool         `json:"showVirtualEnv"`
+	ShowCwd             bool         `json:"showCwd"`
+	CwdMaxLength        int          `json:"cwdMaxLength"`
+	CwdRelativeToRepo   bool         `json:"cwdRelativeToRepo"`
+	BranchMaxLength     int          `json:"branchMaxLength"`
+	HostnameMaxLength   int          `json:"hostnameMaxLength"`
+	BatteryWarn         int          `json:"batteryWarn"`
+	ShowGit             bool         `json:"showGit"`
+	GitBackend          string       `json:"gitBackend"`
+	ShaLength           int          `json:"shaLength"`
+	SubmodulesDirty     bool         `json:"submodulesDirty"`
+	Branches            []BranchRule `json:"branches"`
+	DetectPrimaryBranch bool         `json:"detectPrimaryBranch"`
+	NoUntracked         []string     `json:"noUntracked"`
+	VcsTimeout          float64      `json:"vcsTimeout"`
+	PromptTimeout       float64      `json:"promptTimeout"`
+	CeilingDirectories  []string     `json:"ceilingDirectories"`
+	Daemon              bool         `json:"daemon"`
+	DaemonTimeout       float64      `json:"daemonTimeout"`
+	ShowHg              bool         `json:"showHg"`
+	ShowReturnCode      bool         `json:"showReturnCode"`
+	ReturnCodeFormat    string       `json:"returnCodeFormat"`
+	ShowDuration        bool         `json:"showDuration"`
+	DurationThreshold   float64      `json:"durationThreshold"`
+	RightSegments       []string     `json:"rightSegments"`
+	MultiLine           bool         `json:"multiLine"`
+	ConnectorTop        string       `json:"connectorTop"`
+	ConnectorBottom     string       `json:"connectorBottom"`
+	MaxWidth            float64      `json:"maxWidth"`
+	Icons               struct {
 		Powerline struct {
-			Added         string `json:"added"`
-			Ahead         string `json:"ahead"`
-			Behind        string `json:"behind"`
-			Branch        string `json:"branch"`
-			Conflicted    string `json:"conflicted"`
-			Detached      string `json:"detached"`
-			Ellipsis      string `json:"ellipsis"`
-			Modified      string `json:"modified"`
-			Phases        string `json:"phases"`
-			ReadOnly      string `json:"readonly"`
-			Removed       string `json:"removed"`
-			Renamed       string `json:"renamed"`
-			SeparatorThin string `json:"separatorthin"`
-			Separator     string `json:"separator"`
-			Untracked     string `json:"untracked"`
+			Added              string `json:"added"`
+			Ahead              string `json:"ahead"`
+			Behind             string `json:"behind"`
+			Branch             string `json:"branch"`
+			Conflicted         string `json:"conflicted"`
+			Detached           string `json:"detached"`
+			Ellipsis           string `json:"ellipsis"`
+			GitDir             string `json:"gitdir"`
+			Modified           string `json:"modified"`
+			Operation          string `json:"operation"`
+			Pending            string `json:"pending"`
+			Phases             string `json:"phases"`
+			ReadOnly           string `json:"readonly"`
+			Removed            string `json:"removed"`
+			Renamed            string `json:"renamed"`
+			SeparatorThin      string `json:"separatorthin"`
+			Separator          string `json:"separator"`
+			SeparatorRightThin string `json:"separatorrightthin"`
+			SeparatorRight     string `json:"separatorright"`
+			StagedModified     string `json:"stagedmodified"`
+			StagedRemoved      string `json:"stagedremoved"`
+			Stale              string `json:"stale"`
+			Stashed            string `json:"stashed"`
+			Submodule          string `json:"submodule"`
+			Untracked          string `json:"untracked"`
+			Worktree           string `json:"worktree"`
 		} `json:"powerline"`
 		Plain struct {
-			Added         string `json:"added"`
-			Ahead         string `json:"ahead"`
-			Behind        string `json:"behind"`
-			Branch        string `json:"branch"`
-			Conflicted    string `json:"conflicted"`
-			Detached      string `json:"detached"`
-			Ellipsis      string `json:"ellipsis"`
-			Modified      string `json:"modified"`
-			Phases        string `json:"phases"`
-			ReadOnly      string `json:"readonly"`
-			Removed       string `json:"removed"`
-			Renamed       string `json:"renamed"`
-			SeparatorThin string `json:"separatorthin"`
-			Separator     string `json:"separator"`
-			Untracked     string `json:"untracked"`
+			Added              string `json:"added"`
+			Ahead              string `json:"ahead"`
+			Behind             string `json:"behind"`
+			Branch             string `json:"branch"`
+			Conflicted         string `json:"conflicted"`
+			Detached           string `json:"detached"`
+			Ellipsis           string `json:"ellipsis"`
+			GitDir             string `json:"gitdir"`
+			Modified           string `json:"modified"`
+			Operation          string `json:"operation"`
+			Pending            string `json:"pending"`
+			Phases             string `json:"phases"`
+			ReadOnly           string `json:"readonly"`
+			Removed            string `json:"removed"`
+			Renamed            string `json:"renamed"`
+			SeparatorThin      string `json:"separatorthin"`
+			Separator          string `json:"separator"`
+			SeparatorRightThin string `json:"separatorrightthin"`
+			SeparatorRight     string `json:"separatorright"`
+			StagedModified     string `json:"stagedmodified"`
+			StagedRemoved      string `json:"stagedremoved"`
+			Stale              string `json:"stale"`
+			Stashed            string `json:"stashed"`
+			Submodule          string `json:"submodule"`
+			Untracked          string `json:"untracked"`
+			Worktree           string `json:"worktree"`
 		} `json:"plain"`
 	} `json:"icons"`
 	Colours struct {
 		Hg struct {
-			BackgroundDefault int `json:"backgroundDefault"`
-			BackgroundChanges int `json:"backgroundChanges"`
-			Text              int `json:"text"`
+			BackgroundDefault powerline.Colour `json:"backgroundDefault"`
+			BackgroundChanges powerline.Colour `json:"backgroundChanges"`
+			Text              powerline.Colour `json:"text"`
 		} `json:"hg"`
 		Git struct {
-			BackgroundDefault int `json:"backgroundDefault"`
-			BackgroundChanges int `json:"backgroundChanges"`
-			Text              int `json:"text"`
+			BackgroundDefault powerline.Colour `json:"backgroundDefault"`
+			BackgroundChanges powerline.Colour `json:"backgroundChanges"`
+			BackgroundStaged  powerline.Colour `json:"backgroundStaged"`
+			Text              powerline.Colour `json:"text"`
 		} `json:"git"`
 		Cwd struct {
-			Background     int `json:"background"`
-			Text           int `json:"text"`
-			HomeBackground int `json:"homeBackground"`
-			HomeText       int `json:"homeText"`
+			Background     powerline.Colour `json:"background"`
+			Text           powerline.Colour `json:"text"`
+			HomeBackground powerline.Colour `json:"homeBackground"`
+			HomeText       powerline.Colour `json:"homeText"`
 		} `json:"cwd"`
 		Virtualenv struct {
-			Background int `json:"background"`
-			Text       int `json:"text"`
+			Background powerline.Colour `json:"background"`
+			Text       powerline.Colour `json:"text"`
 		} `json:"virtualenv"`
 		Returncode struct {
-			Background int `json:"background"`
-			Text       int `json:"text"`
+			Background       powerline.Colour `json:"background"`
+			Text             powerline.Colour `json:"text"`
+			SignalBackground powerline.Colour `json:"signalBackground"`
+			SignalText       powerline.Colour `json:"signalText"`
 		} `json:"returncode"`
 		Lock struct {
-			Background int `json:"background"`
-			Text       int `json:"text"`
+			Background powerline.Colour `json:"background"`
+			Text       powerline.Colour `json:"text"`
 		} `json:"lock"`
 		Dollar struct {
-			Background int `json:"background"`
-			Text       int `json:"text"`
+			Background powerline.Colour `json:"background"`
+			Text       powerline.Colour `json:"text"`
 		} `json:"dollar"`
 		Battery struct {
-			Background int `json:"background"`
-			Text       int `json:"text"`
+			Background powerline.Colour `json:"background"`
+			Text       powerline.Colour `json:"text"`
 		} `json:"battery"`
+		Duration struct {
+			Background powerline.Colour `json:"background"`
+			Text       powerline.Colour `json:"text"`
+		} `json:"duration"`
 	} `json:"colours"`
 	Weights struct {
 		Segments struct {
@@ -95,18 +183,29 @@ type Configuration struct {
 			Lock       int `json:"lock"`
 			Battery    int `json:"battery"`
 			Hostname   int `json:"hostname"`
+			Duration   int `json:"duration"`
 		} `json:"segments"`
 		Parts struct {
-			Branch     int `json:"branch"`
-			Sync       int `json:"sync"`
-			Modified   int `json:"modified"`
-			Untracked  int `json:"untracked"`
-			Added      int `json:"added"`
-			Removed    int `json:"removed"`
-			Deleted    int `json:"deleted"`
-			Renamed    int `json:"renamed"`
-			Phases     int `json:"phases"`
-			Conflicted int `json:"conflicted"`
+			Branch         int `json:"branch"`
+			Sync           int `json:"sync"`
+			Ahead          int `json:"ahead"`
+			Behind         int `json:"behind"`
+			Modified       int `json:"modified"`
+			Untracked      int `json:"untracked"`
+			Added          int `json:"added"`
+			Removed        int `json:"removed"`
+			Deleted        int `json:"deleted"`
+			Renamed        int `json:"renamed"`
+			Phases         int `json:"phases"`
+			Conflicted     int `json:"conflicted"`
+			Operation      int `json:"operation"`
+			Stashed        int `json:"stashed"`
+			StagedModified int `json:"stagedModified"`
+			StagedDeleted  int `json:"stagedDeleted"`
+			Submodule      int `json:"submodule"`
+			Worktree       int `json:"worktree"`
+			GitDir         int `json:"gitDir"`
+			Stale          int `json:"stale"`
 		} `json:"parts"`
 	} `json:"weights"`
 }
@@ -120,13 +219,24 @@ func (self *Configuration) SetDefaults() {
 	self.HostnameMaxLength = 12
 	self.BatteryWarn = 0
 	self.ShowGit = true
+	self.GitBackend = "exec"
+	self.ShaLength = 7
+	self.Branches = []BranchRule{{Pattern: "master", Vcs: "git", Primary: true}, {Pattern: "default", Vcs: "hg", Primary: true}}
 	self.ShowHg = true
+	self.VcsTimeout = 1
+	self.PromptTimeout = 1.5
+	self.Daemon = true
+	self.DaemonTimeout = 0.01
 	self.ShowReturnCode = true
+	self.ReturnCodeFormat = "both"
+	self.ShowDuration = true
+	self.DurationThreshold = 5
 	self.Colours.Hg.BackgroundDefault = 22
 	self.Colours.Hg.BackgroundChanges = 64
 	self.Colours.Hg.Text = 251
 	self.Colours.Git.BackgroundDefault = 17
 	self.Colours.Git.BackgroundChanges = 21
+	self.Colours.Git.BackgroundStaged = 28
 	self.Colours.Git.Text = 251
 	self.Colours.Cwd.Background = 40
 	self.Colours.Cwd.Text = 237
@@ -136,10 +246,14 @@ func (self *Configuration) SetDefaults() {
 	self.Colours.Virtualenv.Text = 0
 	self.Colours.Returncode.Background = 196
 	self.Colours.Returncode.Text = 16
+	self.Colours.Returncode.SignalBackground = 129
+	self.Colours.Returncode.SignalText = 15
 	self.Colours.Lock.Background = 124
 	self.Colours.Lock.Text = 254
 	self.Colours.Dollar.Background = 240
 	self.Colours.Dollar.Text = 15
 	self.Colours.Battery.Background = 196
 	self.Colours.Battery.Text = 16
+	self.Colours.Duration.Background = 237
+	self.Colours.Duration.Text = 250
 }
@@ -16,6 +16,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -29,6 +30,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/scottweston/powerline-shell-go/powerline"
 	"github.com/scottweston/powerline-shell-go/powerline-config"
@@ -38,15 +40,47 @@ var build string
 
 // Helpers
 
-func getCurrentWorkingDir() (string, []string) {
+func getCurrentWorkingDir() string {
 	dir, err := filepath.Abs(".")
 	if err != nil {
 		log.Fatal(err)
 	}
+	return dir
+}
+
+// splitCwd splits dir for the cwd segment, with the home directory as ~
+func splitCwd(dir string) []string {
 	userDir := strings.Replace(dir, os.Getenv("HOME"), "~", 1)
 	userDir = strings.TrimSuffix(userDir, "/")
-	parts := strings.Split(userDir, "/")
-	return dir, parts
+	return strings.Split(userDir, "/")
+}
+
+// parseDuration accepts a bare number of seconds or anything understood by
+// time.ParseDuration, e.g. "1500ms" or "2034567us"
+func parseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// splitNames splits a comma separated list of segment names
+func splitNames(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' })
+}
+
+// parsePipeStatus splits the exit codes of a pipeline, separated by commas
+// or spaces as given by ${PIPESTATUS[*]} or $pipestatus
+func parsePipeStatus(value string) ([]int, error) {
+	var codes []int
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
 }
 
 func getVirtualEnv() string {
@@ -59,9 +93,62 @@ func getVirtualEnv() string {
 	return virtualEnvName
 }
 
+// onSide decides if the named segment belongs to the side being rendered
+func onSide(conf config.Configuration, name string, right bool) bool {
+	for _, segment := range conf.RightSegments {
+		if segment == name {
+			return right
+		}
+	}
+	return !right
+}
+
 // Segment generators
 
-func addHgInfo(conf config.Configuration, p powerline.Powerline) *powerline.Segment {
+// classifyBranch reports whether branch is a primary one, either configured or
+// detected, and the colours given to it by the first rule with any
+func classifyBranch(conf config.Configuration, vcs string, branch string, detected string) (bool, *config.BranchRule) {
+	primary := conf.DetectPrimaryBranch && detected != "" && branch == detected
+	var coloured *config.BranchRule
+	for i, rule := range conf.Branches {
+		if !rule.Matches(vcs, branch) {
+			continue
+		}
+		primary = primary || rule.Primary
+		if coloured == nil && (rule.Background != nil || rule.Text != nil) {
+			coloured = &conf.Branches[i]
+		}
+	}
+	return primary, coloured
+}
+
+// branchColours applies a branch rule's colours to the segment, the
+// background only while it's clean so changes still show
+func branchColours(segment *powerline.Segment, rule *config.BranchRule, clean bool) {
+	if rule == nil {
+		return
+	}
+	if rule.Background != nil && clean {
+		segment.Background = *rule.Background
+	}
+	if rule.Text != nil {
+		segment.Foreground = *rule.Text
+	}
+}
+
+// readHgSummary runs `hg summary` in dir, the output is empty when it fails
+func readHgSummary(ctx context.Context, dir string) string {
+	cmd := exec.CommandContext(ctx, "hg", "sum", "--color=never", "-y")
+	cmd.Dir = dir
+	cmd.WaitDelay = vcsWaitDelay
+	hg, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return string(hg)
+}
+
+func addHgInfo(conf config.Configuration, hg string, stale bool, p powerline.Powerline) *powerline.Segment {
 	var fmt_str string
 
 	segment := powerline.Segment{}
@@ -69,38 +156,36 @@ func addHgInfo(conf config.Configuration, p powerline.Powerline) *powerline.Segm
 	branch_colour := conf.Colours.Hg.BackgroundDefault
 	text_colour := conf.Colours.Hg.Text
 
-	hg, err := exec.Command("hg", "sum", "--color=never", "-y").Output()
-
-	if err == nil {
+	if hg != "" {
 		// branch:
 		reBranch := regexp.MustCompile(`(?m)^branch: (.*)$`)
-		matchBranch := reBranch.FindStringSubmatch(string(hg))
+		matchBranch := reBranch.FindStringSubmatch(hg)
 
 		// commit:
 		// %d modified, %d added, %d removed, %d renamed, %d copied
 		// %d deleted, %d unknown, %d unresolved, %d subrepos
 		reModifed := regexp.MustCompile(`(?m)^commit:.* (.*) modified`)
-		res_mod := reModifed.FindStringSubmatch(string(hg))
+		res_mod := reModifed.FindStringSubmatch(hg)
 		reUntracked := regexp.MustCompile(`(?m)^commit:.* (.*) unknown`)
-		res_untrk := reUntracked.FindStringSubmatch(string(hg))
+		res_untrk := reUntracked.FindStringSubmatch(hg)
 		reAdded := regexp.MustCompile(`(?m)^commit:.* (.*) added`)
-		res_added := reAdded.FindStringSubmatch(string(hg))
+		res_added := reAdded.FindStringSubmatch(hg)
 		reRemoved := regexp.MustCompile(`(?m)^commit:.* (.*) removed`)
-		res_remove := reRemoved.FindStringSubmatch(string(hg))
+		res_remove := reRemoved.FindStringSubmatch(hg)
 		reClean := regexp.MustCompile(`(?m)^commit:.*\(clean\)`)
-		res_clean := reClean.FindStringSubmatch(string(hg))
+		res_clean := reClean.FindStringSubmatch(hg)
 
 		// update:
 		reUpdate := regexp.MustCompile(`(?m)^update: (.*) new`)
-		res_update := reUpdate.FindStringSubmatch(string(hg))
+		res_update := reUpdate.FindStringSubmatch(hg)
 
 		// phases:
 		rePublic := regexp.MustCompile(`(?m)^phases:.* (.*) public`)
-		res_public := rePublic.FindStringSubmatch(string(hg))
+		res_public := rePublic.FindStringSubmatch(hg)
 		reDraft := regexp.MustCompile(`(?m)^phases:.* (.*) draft`)
-		res_draft := reDraft.FindStringSubmatch(string(hg))
+		res_draft := reDraft.FindStringSubmatch(hg)
 		reSecret := regexp.MustCompile(`(?m)^phases:.* (.*) secret`)
-		res_secret := reSecret.FindStringSubmatch(string(hg))
+		res_secret := reSecret.FindStringSubmatch(hg)
 
 		if len(res_clean) == 0 {
 			branch_colour = conf.Colours.Hg.BackgroundChanges
@@ -115,19 +200,16 @@ func addHgInfo(conf config.Configuration, p powerline.Powerline) *powerline.Segm
 			branch := matchBranch[1]
 			branch_fmt := branch
 			if conf.BranchMaxLength > 3 {
-				if len(branch) > conf.BranchMaxLength {
-					sml := int(conf.BranchMaxLength/2 - 1)
-					if sml > 0 {
-						branch_fmt = branch[0:sml] + p.Ellipsis + branch[len(branch)-sml:]
-					}
-				}
+				branch_fmt = powerline.Truncate(branch, conf.BranchMaxLength, p.Ellipsis)
 			}
-			if branch != "default" {
+			primary, rule := classifyBranch(conf, "hg", branch, "")
+			if !primary {
 				fmt_str = p.Branch + " " + branch_fmt
 			} else {
 				fmt_str = branch_fmt
 			}
-			segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Branch, Dirty: true})
+			branchColours(&segment, rule, len(res_clean) > 0)
+			segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Branch, Dirty: true, Shrink: true})
 		}
 
 		// phases
@@ -203,170 +285,179 @@ func addHgInfo(conf config.Configuration, p powerline.Powerline) *powerline.Segm
 			segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Removed, Dirty: true})
 		}
 
+		return &segment
+	} else if stale {
+		// too slow to tell
+		segment.Background = branch_colour
+		segment.Foreground = text_colour
+		segment.Weight = conf.Weights.Segments.Hg
+		segment.Parts = append(segment.Parts, powerline.Part{Text: p.Stale, Weight: conf.Weights.Parts.Stale, Dirty: false})
 		return &segment
 	} else {
 		return nil
 	}
 }
 
-func addGitInfo(conf config.Configuration, porcelain string, p powerline.Powerline) *powerline.Segment {
-	var fmt_str string
+// how long a killed VCS command's children get to close its output
+const vcsWaitDelay = 100 * time.Millisecond
 
-	segment := powerline.Segment{}
-
-	branch_colour := conf.Colours.Git.BackgroundDefault
-	text_colour := conf.Colours.Git.Text
-
-	// what branch
-	reBranch := regexp.MustCompile(`(?m)^## (([^ \n]+)[\.]{3}?.*|.* on (\S+))$`)
-	matchBranch := reBranch.FindStringSubmatch(porcelain)
-
-	// detached?
-	reDetached := regexp.MustCompile(`(?m)^## .* \(no branch\)`)
-	matchDetached := reDetached.FindStringSubmatch(porcelain)
-
-	// are we ahead/behind
-	reStatus := regexp.MustCompile(`(?m)^## .* \[(ahead|behind) ([0-9]+)\]`)
-	matchStatus := reStatus.FindStringSubmatch(porcelain)
+// vcsContext bounds how long a VCS probe may take, vcsTimeout is in seconds
+func vcsContext(parent context.Context, conf config.Configuration) (context.Context, context.CancelFunc) {
+	if conf.VcsTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(conf.VcsTimeout*float64(time.Second)))
+}
 
-	// renamed files
-	rename, _ := regexp.Compile(`(?m)^R. `)
-	rename_res := rename.FindAllString(porcelain, -1)
+// addPending is the placeholder for a VCS segment that's still being worked
+// out, in its place and colours
+func addPending(conf config.Configuration, name string, p powerline.Powerline) *powerline.Segment {
+	var segment powerline.Segment
+	switch name {
+	case "git":
+		segment = powerline.Segment{Foreground: conf.Colours.Git.Text, Background: conf.Colours.Git.BackgroundDefault, Weight: conf.Weights.Segments.Git}
+	case "hg":
+		segment = powerline.Segment{Foreground: conf.Colours.Hg.Text, Background: conf.Colours.Hg.BackgroundDefault, Weight: conf.Weights.Segments.Hg}
+	default:
+		return nil
+	}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: p.Pending, Weight: conf.Weights.Parts.Branch, Dirty: false})
+	return &segment
+}
 
-	// added files
-	add, _ := regexp.Compile(`(?m)^A. `)
-	add_res := add.FindAllString(porcelain, -1)
+// countPart shows icon alone for a single item and prefixed by the count for more
+func countPart(count int, icon string, weight int) powerline.Part {
+	if count > 1 {
+		return powerline.Part{Text: fmt.Sprintf("%d%s", count, icon), Weight: weight, Dirty: true}
+	}
+	return powerline.Part{Text: icon, Weight: weight, Dirty: true}
+}
 
-	// modified files
-	mod, _ := regexp.Compile(`(?m)^.M `)
-	mod_res := mod.FindAllString(porcelain, -1)
+// abbreviate shortens a commit hash to length characters, at least 4
+func abbreviate(oid string, length int) string {
+	if length < 4 {
+		length = 4
+	}
+	if len(oid) > length {
+		return oid[:length]
+	}
+	return oid
+}
 
-	// uncommitted files
-	uncom, _ := regexp.Compile(`(?m)^\?\? `)
-	uncom_res := uncom.FindAllString(porcelain, -1)
+func addGitInfo(conf config.Configuration, status gitStatus, p powerline.Powerline) *powerline.Segment {
+	var fmt_str string
 
-	// removed files
-	del, _ := regexp.Compile(`(?m)^(D.|.D) `)
-	del_res := del.FindAllString(porcelain, -1)
+	segment := powerline.Segment{}
 
-	// conflicted files
-	cfd, _ := regexp.Compile(`(?m)^DD|AU|UD|UA|DU|AA|UU .*$`)
-	cfd_res := cfd.FindAllString(porcelain, -1)
+	branch_colour := conf.Colours.Git.BackgroundDefault
+	text_colour := conf.Colours.Git.Text
 
-	// any changes at all?
-	if len(rename_res) > 0 || len(add_res) > 0 || len(mod_res) > 0 || len(uncom_res) > 0 || len(del_res) > 0 || len(cfd_res) > 0 {
+	// any changes at all? Only staged ones are what `git commit` would take
+	if status.Unstaged() {
 		branch_colour = conf.Colours.Git.BackgroundChanges
+	} else if status.Staged() {
+		branch_colour = conf.Colours.Git.BackgroundStaged
 	}
 
 	segment.Background = branch_colour
 	segment.Foreground = text_colour
 	segment.Weight = conf.Weights.Segments.Git
 
-	// branch name
-	if len(matchBranch) > 0 {
-		branch := matchBranch[2]
+	// branch name, or the tag or commit when detached
+	if status.Detached {
+		name, shrink := "HEAD", true
+		if status.Tag != "" {
+			name = status.Tag
+		} else if status.Oid != "" {
+			name, shrink = abbreviate(status.Oid, conf.ShaLength), false
+		}
+		if shrink && conf.BranchMaxLength > 3 {
+			name = powerline.Truncate(name, conf.BranchMaxLength, p.Ellipsis)
+		}
+		segment.Parts = append(segment.Parts, powerline.Part{Text: p.Detached + " " + name, Weight: conf.Weights.Parts.Branch, Dirty: true, Shrink: shrink})
+	} else {
+		branch := status.Branch
 		branch_fmt := branch
 		if conf.BranchMaxLength > 3 {
-			if len(branch) > conf.BranchMaxLength {
-				sml := int(conf.BranchMaxLength/2 - 1)
-				if sml > 0 {
-					branch_fmt = branch[0:sml] + p.Ellipsis + branch[len(branch)-sml:]
-				}
-			}
+			branch_fmt = powerline.Truncate(branch, conf.BranchMaxLength, p.Ellipsis)
 		}
 
-		if len(matchDetached) > 0 {
-			fmt_str = p.Detached + " "
-		} else {
-			fmt_str = ""
-		}
-		if branch != "master" {
-			fmt_str = fmt.Sprintf("%s%s ", fmt_str, p.Branch)
+		fmt_str = ""
+		primary, rule := classifyBranch(conf, "git", branch, status.Primary)
+		if !primary {
+			fmt_str = fmt.Sprintf("%s ", p.Branch)
 		}
+		branchColours(&segment, rule, !status.Unstaged() && !status.Staged())
 		fmt_str = fmt.Sprintf("%s%s", fmt_str, branch_fmt)
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Branch, Dirty: true})
+		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Branch, Dirty: true, Shrink: true})
 	}
 
-	// ahead/behind
-	if len(matchStatus) > 0 {
-		num, _ := strconv.Atoi(matchStatus[2])
-
-		if matchStatus[1] == "behind" {
-			if num > 1 {
-				fmt_str = fmt.Sprintf("%s%s", matchStatus[2], p.Behind)
-			} else {
-				fmt_str = p.Behind
-			}
-		} else if matchStatus[1] == "ahead" {
-			if num > 1 {
-				fmt_str = fmt.Sprintf("%s%s", matchStatus[2], p.Ahead)
-			} else {
-				fmt_str = p.Ahead
-			}
-		} else {
-			fmt_str = "unk"
-		}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Sync, Dirty: true})
+	// the rest of the status took too long to find out
+	if status.Stale {
+		segment.Parts = append(segment.Parts, powerline.Part{Text: p.Stale, Weight: conf.Weights.Parts.Stale, Dirty: false})
 	}
 
-	// renamed files
-	if len(rename_res) > 0 {
-		if (len(rename_res)) > 1 {
-			fmt_str = fmt.Sprintf("%d%s", len(rename_res), p.Renamed)
-		} else {
-			fmt_str = p.Renamed
-		}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Renamed, Dirty: true})
+	// where in the repository we are
+	if status.GitDir != "" {
+		segment.Parts = append(segment.Parts, powerline.Part{Text: p.GitDir + " " + status.GitDir, Weight: conf.Weights.Parts.GitDir, Dirty: false})
 	}
-
-	// added files
-	if len(add_res) > 0 {
-		if (len(add_res)) > 1 {
-			fmt_str = fmt.Sprintf("%d%s", len(add_res), p.Added)
-		} else {
-			fmt_str = p.Added
-		}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Added, Dirty: true})
+	if status.Worktree != "" {
+		segment.Parts = append(segment.Parts, powerline.Part{Text: p.Worktree + " " + status.Worktree, Weight: conf.Weights.Parts.Worktree, Dirty: true})
+	}
+	if status.Submodule != "" {
+		segment.Parts = append(segment.Parts, powerline.Part{Text: p.Submodule + " " + status.Submodule, Weight: conf.Weights.Parts.Submodule, Dirty: true})
 	}
 
-	// modified files
-	if len(mod_res) > 0 {
-		if (len(mod_res)) > 1 {
-			fmt_str = fmt.Sprintf("%d%s", len(mod_res), p.Modified)
-		} else {
-			fmt_str = p.Modified
-		}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Modified, Dirty: true})
+	// rebase, merge etc. in progress
+	if status.Operation != "" {
+		segment.Parts = append(segment.Parts, powerline.Part{Text: p.Operation + " " + status.Operation, Weight: conf.Weights.Parts.Operation, Dirty: true})
 	}
 
-	// untracked files
-	if len(uncom_res) > 0 {
-		if (len(uncom_res)) > 1 {
-			fmt_str = fmt.Sprintf("%d%s", len(uncom_res), p.Untracked)
-		} else {
-			fmt_str = p.Untracked
-		}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Untracked, Dirty: true})
+	// ahead/behind, "sync" still weights both when they aren't set
+	ahead_weight := conf.Weights.Parts.Ahead
+	if ahead_weight == 0 {
+		ahead_weight = conf.Weights.Parts.Sync
+	}
+	behind_weight := conf.Weights.Parts.Behind
+	if behind_weight == 0 {
+		behind_weight = conf.Weights.Parts.Sync
+	}
+	if status.Ahead > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Ahead, p.Ahead, ahead_weight))
+	}
+	if status.Behind > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Behind, p.Behind, behind_weight))
 	}
 
-	// deleted files
-	if len(del_res) > 0 {
-		if (len(del_res)) > 1 {
-			fmt_str = fmt.Sprintf("%d%s", len(del_res), p.Removed)
-		} else {
-			fmt_str = p.Removed
-		}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Deleted, Dirty: true})
+	// staged changes
+	if status.Renamed > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Renamed, p.Renamed, conf.Weights.Parts.Renamed))
+	}
+	if status.Added > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Added, p.Added, conf.Weights.Parts.Added))
+	}
+	if status.StagedModified > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.StagedModified, p.StagedModified, conf.Weights.Parts.StagedModified))
+	}
+	if status.StagedDeleted > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.StagedDeleted, p.StagedRemoved, conf.Weights.Parts.StagedDeleted))
 	}
 
-	// conflicted files
-	if len(cfd_res) > 0 {
-		if (len(cfd_res)) > 1 {
-			fmt_str = fmt.Sprintf("%d%s", len(cfd_res), p.Conflicted)
-		} else {
-			fmt_str = p.Conflicted
-		}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt_str, Weight: conf.Weights.Parts.Conflicted, Dirty: true})
+	// work tree changes
+	if status.Modified > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Modified, p.Modified, conf.Weights.Parts.Modified))
+	}
+	if status.Untracked > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Untracked, p.Untracked, conf.Weights.Parts.Untracked))
+	}
+	if status.Deleted > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Deleted, p.Removed, conf.Weights.Parts.Deleted))
+	}
+	if status.Conflicted > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Conflicted, p.Conflicted, conf.Weights.Parts.Conflicted))
+	}
+	if status.Stashed > 0 {
+		segment.Parts = append(segment.Parts, countPart(status.Stashed, p.Stashed, conf.Weights.Parts.Stashed))
 	}
 
 	return &segment
@@ -381,12 +472,7 @@ func addCwd(conf config.Configuration, cwdParts []string, p powerline.Powerline)
 	// limit part length, less than 3 makes no sense
 	if conf.CwdMaxLength > 3 {
 		for i, part := range cwdParts {
-			if len(part) > conf.CwdMaxLength {
-				sml := int(conf.CwdMaxLength/2 - 1)
-				if sml > 0 {
-					cwdParts[i] = part[0:sml] + p.Ellipsis + part[len(part)-sml:]
-				}
-			}
+			cwdParts[i] = powerline.Truncate(part, conf.CwdMaxLength, p.Ellipsis)
 		}
 	}
 
@@ -409,15 +495,15 @@ func addCwd(conf config.Configuration, cwdParts []string, p powerline.Powerline)
 	}
 
 	segment = append(segment, powerline.Segment{Foreground: fore_col, Background: back_col, Weight: conf.Weights.Segments.Cwd})
-	segment[len(segment)-1].Parts = append(segment[len(segment)-1].Parts, powerline.Part{Text: cwdParts[0], Dirty: true})
+	segment[len(segment)-1].Parts = append(segment[len(segment)-1].Parts, powerline.Part{Text: cwdParts[0], Dirty: true, Shrink: true})
 	cwdParts = cwdParts[1:]
 
 	// if there's only one more we show it, otherwise it's an ellipsis then the last part
 	if len(cwdParts) == 1 {
-		segment[len(segment)-1].Parts = append(segment[len(segment)-1].Parts, powerline.Part{Text: cwdParts[0], Dirty: true})
+		segment[len(segment)-1].Parts = append(segment[len(segment)-1].Parts, powerline.Part{Text: cwdParts[0], Dirty: true, Shrink: true})
 	} else if len(cwdParts) > 1 {
 		segment[len(segment)-1].Parts = append(segment[len(segment)-1].Parts, powerline.Part{Text: p.Ellipsis, Dirty: false})
-		segment[len(segment)-1].Parts = append(segment[len(segment)-1].Parts, powerline.Part{Text: cwdParts[len(cwdParts)-1], Dirty: true})
+		segment[len(segment)-1].Parts = append(segment[len(segment)-1].Parts, powerline.Part{Text: cwdParts[len(cwdParts)-1], Dirty: true, Shrink: true})
 	}
 
 	return segment
@@ -432,10 +518,76 @@ func addVirtulEnvName(conf config.Configuration, virtualEnvName string) *powerli
 	return nil
 }
 
+// describeReturnCode labels the codes used by shells for commands that
+// couldn't run or were killed by a signal, following conf.ReturnCodeFormat
+// ("number", "name" or "both"). signal is set for deaths by a signal
+func describeReturnCode(conf config.Configuration, code int) (text string, signal bool) {
+	var name string
+	switch {
+	case code == 126:
+		name = "NOEXEC"
+	case code == 127:
+		name = "NOTFOUND"
+	case code > 128:
+		name = SignalName(code - 128)
+		signal = name != ""
+	}
+
+	switch {
+	case name == "" || conf.ReturnCodeFormat == "number":
+		text = strconv.Itoa(code)
+	case conf.ReturnCodeFormat == "name":
+		text = name
+	default:
+		text = fmt.Sprintf("%d %s", code, name)
+	}
+	return text, signal
+}
+
 func addReturnCode(conf config.Configuration, ret_code int) *powerline.Segment {
 	if ret_code != 0 {
+		return addPipeStatus(conf, []int{ret_code})
+	}
+	return nil
+}
+
+func addPipeStatus(conf config.Configuration, codes []int) *powerline.Segment {
+	failed := false
+	killed := false
+	var text []string
+	for _, code := range codes {
+		description, signal := describeReturnCode(conf, code)
+		failed = failed || code != 0
+		killed = killed || signal
+		text = append(text, description)
+	}
+	if failed {
 		segment := powerline.Segment{Foreground: conf.Colours.Returncode.Text, Background: conf.Colours.Returncode.Background, Weight: conf.Weights.Segments.Returncode}
-		segment.Parts = append(segment.Parts, powerline.Part{Text: fmt.Sprintf("%d", ret_code), Dirty: false})
+		if killed {
+			segment.Foreground = conf.Colours.Returncode.SignalText
+			segment.Background = conf.Colours.Returncode.SignalBackground
+		}
+		segment.Parts = append(segment.Parts, powerline.Part{Text: strings.Join(text, "|"), Dirty: false})
+		return &segment
+	}
+	return nil
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d < time.Hour:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	default:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+}
+
+func addDuration(conf config.Configuration, duration time.Duration) *powerline.Segment {
+	if duration > 0 && duration.Seconds() >= conf.DurationThreshold {
+		segment := powerline.Segment{Foreground: conf.Colours.Duration.Text, Background: conf.Colours.Duration.Background, Weight: conf.Weights.Segments.Duration}
+		segment.Parts = append(segment.Parts, powerline.Part{Text: formatDuration(duration), Dirty: false})
 		return &segment
 	}
 	return nil
@@ -456,14 +608,9 @@ func addHostname(conf config.Configuration, includeUsername bool, hostHash bool,
 		return nil
 	}
 
-	if len(hostname) > conf.HostnameMaxLength {
-		sml := int(conf.HostnameMaxLength/2 - 1)
-		if sml > 0 {
-			hostname = hostname[0:sml] + p.Ellipsis + hostname[len(hostname)-sml:]
-		}
-	}
+	hostname = powerline.Truncate(hostname, conf.HostnameMaxLength, p.Ellipsis)
 
-	back := 12
+	var back powerline.Colour = 12
 
 	if hostHash {
 		// create a colour hash for the hostname
@@ -471,7 +618,7 @@ func addHostname(conf config.Configuration, includeUsername bool, hostHash bool,
 		for _, v := range hostname {
 			sum += int(v)
 		}
-		back = sum % 15
+		back = powerline.Colour(sum % 15)
 	}
 
 	if includeUsername {
@@ -505,17 +652,57 @@ func addBatteryWarn(conf config.Configuration) *powerline.Segment {
 }
 
 func addDollarPrompt(conf config.Configuration, dollar string) *powerline.Segment {
-	segment := powerline.Segment{Foreground: conf.Colours.Dollar.Text, Background: conf.Colours.Dollar.Background, Weight: -1000}
+	segment := powerline.Segment{Foreground: conf.Colours.Dollar.Text, Background: conf.Colours.Dollar.Background, Weight: -1000, NewLine: conf.MultiLine, Keep: true}
 	segment.Parts = append(segment.Parts, powerline.Part{Text: dollar, Dirty: false})
 	return &segment
 }
 
+// installSnippet is what `<shell> install` prints to be evaluated by the
+// shell's startup file
+func installSnippet(shell string) string {
+	switch shell {
+	case "bash":
+		return `function _powerline_timer() { [ -n "$_powerline_start" ] || _powerline_start=${EPOCHREALTIME:-$SECONDS}; };
+trap '_powerline_timer' DEBUG;
+function _update_ps1() { local ret=$? pipestatus="${PIPESTATUS[*]}" end=${EPOCHREALTIME:-$SECONDS} duration=0; [ -n "$_powerline_start" ] && duration=$(( ${end/[.,]/} - ${_powerline_start/[.,]/} ))${EPOCHREALTIME:+u}s; local args="$ret --duration=$duration --pipestatus=${pipestatus// /,}"; export PS1="$(powerline-shell-go bash $args --right 2> /dev/null)$(powerline-shell-go bash $args 2> /dev/null)"; };
+export PROMPT_COMMAND="_update_ps1; $PROMPT_COMMAND
+unset _powerline_start";`
+	case "zsh":
+		return `zmodload zsh/datetime;
+typeset -gA _powerline_async;
+function powerline_preexec() { _powerline_start=$EPOCHREALTIME; };
+function powerline_async_done() { local fd=$1 name=${_powerline_async[$1]} placeholder text; IFS= read -r -d '' -u $fd placeholder; IFS= read -r -d '' -u $fd text; zle -F $fd; exec {fd}<&-; unset "_powerline_async[$fd]"; if [ -n "$placeholder" ]; then; typeset -g "$name=${(P)name/${(b)placeholder}/$text}"; elif [ -n "$text" ]; then; typeset -g "$name=$text"; fi; zle && zle reset-prompt; };
+function powerline_async_job() { local placeholder text; placeholder="$(powerline-shell-go zsh "$@" --pending=git,hg --segments=git,hg 2> /dev/null)"; [ -z "$placeholder" ] && return; text="$(powerline-shell-go zsh "$@" --segments=git,hg 2> /dev/null)"; if [ -z "$text" ]; then; placeholder=; text="$(powerline-shell-go zsh "$@" 2> /dev/null)"; fi; print -rn -- "$placeholder"$'\0'"$text"$'\0'; };
+function powerline_async() { local fd; exec {fd}< <(powerline_async_job "${@:2}"); _powerline_async[$fd]=$1; zle -F $fd powerline_async_done; };
+function powerline_precmd() { local ret=$? pipes=${(j:,:)pipestatus} fd; local -i duration=0; [ -n "$_powerline_start" ] && (( duration = (EPOCHREALTIME - _powerline_start) * 1000 )); unset _powerline_start; for fd in ${(k)_powerline_async}; do; zle -F $fd; exec {fd}<&-; done; _powerline_async=(); local -a args; args=($ret --duration=${duration}ms --pipestatus=$pipes); export PS1="$(powerline-shell-go zsh $args --pending=git,hg 2> /dev/null)"; export RPROMPT="$(powerline-shell-go zsh $args --pending=git,hg --right 2> /dev/null)"; powerline_async PS1 $args; powerline_async RPROMPT $args --right; };
+function install_powerline_precmd() { for s in "${precmd_functions[@]}"; do; if [ "$s" = "powerline_precmd" ]; then; return; fi; done; precmd_functions+=(powerline_precmd); preexec_functions+=(powerline_preexec); };
+install_powerline_precmd;`
+	case "fish":
+		return `function fish_prompt; powerline-shell-go fish $status --pipestatus="$pipestatus" --duration={$CMD_DURATION}ms 2> /dev/null; end;
+function fish_right_prompt; powerline-shell-go fish $status --pipestatus="$pipestatus" --duration={$CMD_DURATION}ms --right 2> /dev/null; end;`
+	case "tmux":
+		return `set -g status-left "#(cd '#{pane_current_path}' && powerline-shell-go tmux 0 2> /dev/null)"
+set -g status-right "#(cd '#{pane_current_path}' && powerline-shell-go tmux 0 --right 2> /dev/null)"`
+	}
+	return fmt.Sprintf("echo Unsupported shell: %s;", shell)
+}
+
+// wantsInstall reports whether the arguments ask for the install snippet,
+// "install" may follow the return code, e.g. "fish 0 install"
+func wantsInstall(args []string) bool {
+	return len(args) > 1 && args[len(args)-1] == "install"
+}
+
 func main() {
 	var configuration config.Configuration
 	var set_title string = ""
 	configuration.SetDefaults()
 	shell := "bash"
 	last_retcode := 0
+	right := false
+	var duration time.Duration
+	var pipestatus []int
+	var only, pending []string
 
 	user, err := user.Current()
 	var data []byte
@@ -532,39 +719,62 @@ func main() {
 		}
 	}
 
-	if len(os.Args) > 1 {
-		if os.Args[1] == "version" || os.Args[1] == "build" {
+	var args []string
+	for _, arg := range os.Args[1:] {
+		switch {
+		case arg == "--right":
+			right = true
+		case strings.HasPrefix(arg, "--duration="):
+			duration, err = parseDuration(strings.TrimPrefix(arg, "--duration="))
+			if err != nil {
+				fmt.Printf("invalid duration(%s)> ", err)
+				os.Exit(1)
+			}
+		case strings.HasPrefix(arg, "--segments="):
+			only = splitNames(strings.TrimPrefix(arg, "--segments="))
+		case strings.HasPrefix(arg, "--pending="):
+			pending = splitNames(strings.TrimPrefix(arg, "--pending="))
+		case strings.HasPrefix(arg, "--pipestatus="):
+			pipestatus, err = parsePipeStatus(strings.TrimPrefix(arg, "--pipestatus="))
+			if err != nil {
+				fmt.Printf("invalid pipestatus(%s)> ", err)
+				os.Exit(1)
+			}
+		default:
+			args = append(args, arg)
+		}
+	}
+
+	if len(args) > 0 {
+		if args[0] == "version" || args[0] == "build" {
 			if build != "" {
 				fmt.Println(build)
 			} else {
 				fmt.Println("unknown")
 			}
 			os.Exit(0)
+		} else if args[0] == "daemon" {
+			if err := runDaemon(configuration); err != nil {
+				fmt.Fprintf(os.Stderr, "daemon: %s\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
 		} else {
-			shell = os.Args[1]
+			shell = args[0]
 		}
 	}
 
-	if len(os.Args) > 2 {
-		last_retcode, err = strconv.Atoi(os.Args[2])
-		if err != nil {
-			if os.Args[2] == "install" {
-				if shell == "bash" {
-					fmt.Println(`function _update_ps1() { export PS1="$(powerline-shell-go bash $? 2> /dev/null)"; };
-export PROMPT_COMMAND="_update_ps1; $PROMPT_COMMAND";`)
-				} else if shell == "zsh" {
-					fmt.Println(`function powerline_precmd() { export PS1="$(powerline-shell-go zsh $? 2> /dev/null)"; };
-function install_powerline_precmd() { for s in "${precmd_functions[@]}"; do; if [ "$s" = "powerline_precmd" ]; then; return; fi; done; precmd_functions+=(powerline_precmd); };
-install_powerline_precmd;`)
-				} else {
-					fmt.Printf("echo Unsupported shell: %s;\n", shell)
-				}
-				os.Exit(0)
-			}
-		}
+	if wantsInstall(args) {
+		fmt.Println(installSnippet(shell))
+		os.Exit(0)
+	}
+	if len(args) > 1 {
+		last_retcode, _ = strconv.Atoi(args[1])
 	}
 
-	if shell != "bash" && shell != "zsh" {
+	switch shell {
+	case "bash", "zsh", "fish", "ansi", "tmux":
+	default:
 		fmt.Printf("unsupported shell(%s)> ", shell)
 		os.Exit(1)
 	}
@@ -593,9 +803,18 @@ install_powerline_precmd;`)
 		if configuration.Icons.Powerline.Ellipsis != "" {
 			p.Ellipsis = configuration.Icons.Powerline.Ellipsis
 		}
+		if configuration.Icons.Powerline.GitDir != "" {
+			p.GitDir = configuration.Icons.Powerline.GitDir
+		}
 		if configuration.Icons.Powerline.Modified != "" {
 			p.Modified = configuration.Icons.Powerline.Modified
 		}
+		if configuration.Icons.Powerline.Operation != "" {
+			p.Operation = configuration.Icons.Powerline.Operation
+		}
+		if configuration.Icons.Powerline.Pending != "" {
+			p.Pending = configuration.Icons.Powerline.Pending
+		}
 		if configuration.Icons.Powerline.Phases != "" {
 			p.Phases = configuration.Icons.Powerline.Phases
 		}
@@ -614,9 +833,33 @@ install_powerline_precmd;`)
 		if configuration.Icons.Powerline.Separator != "" {
 			p.Separator = configuration.Icons.Powerline.Separator
 		}
+		if configuration.Icons.Powerline.SeparatorRightThin != "" {
+			p.SeparatorRightThin = configuration.Icons.Powerline.SeparatorRightThin
+		}
+		if configuration.Icons.Powerline.SeparatorRight != "" {
+			p.SeparatorRight = configuration.Icons.Powerline.SeparatorRight
+		}
+		if configuration.Icons.Powerline.StagedModified != "" {
+			p.StagedModified = configuration.Icons.Powerline.StagedModified
+		}
+		if configuration.Icons.Powerline.StagedRemoved != "" {
+			p.StagedRemoved = configuration.Icons.Powerline.StagedRemoved
+		}
+		if configuration.Icons.Powerline.Stale != "" {
+			p.Stale = configuration.Icons.Powerline.Stale
+		}
+		if configuration.Icons.Powerline.Stashed != "" {
+			p.Stashed = configuration.Icons.Powerline.Stashed
+		}
+		if configuration.Icons.Powerline.Submodule != "" {
+			p.Submodule = configuration.Icons.Powerline.Submodule
+		}
 		if configuration.Icons.Powerline.Untracked != "" {
 			p.Untracked = configuration.Icons.Powerline.Untracked
 		}
+		if configuration.Icons.Powerline.Worktree != "" {
+			p.Worktree = configuration.Icons.Powerline.Worktree
+		}
 	} else {
 		p = powerline.NewPowerline(shell, false)
 		if configuration.Icons.Plain.Added != "" {
@@ -640,9 +883,18 @@ install_powerline_precmd;`)
 		if configuration.Icons.Plain.Ellipsis != "" {
 			p.Ellipsis = configuration.Icons.Plain.Ellipsis
 		}
+		if configuration.Icons.Plain.GitDir != "" {
+			p.GitDir = configuration.Icons.Plain.GitDir
+		}
 		if configuration.Icons.Plain.Modified != "" {
 			p.Modified = configuration.Icons.Plain.Modified
 		}
+		if configuration.Icons.Plain.Operation != "" {
+			p.Operation = configuration.Icons.Plain.Operation
+		}
+		if configuration.Icons.Plain.Pending != "" {
+			p.Pending = configuration.Icons.Plain.Pending
+		}
 		if configuration.Icons.Plain.Phases != "" {
 			p.Phases = configuration.Icons.Plain.Phases
 		}
@@ -661,49 +913,101 @@ install_powerline_precmd;`)
 		if configuration.Icons.Plain.Separator != "" {
 			p.Separator = configuration.Icons.Plain.Separator
 		}
+		if configuration.Icons.Plain.SeparatorRightThin != "" {
+			p.SeparatorRightThin = configuration.Icons.Plain.SeparatorRightThin
+		}
+		if configuration.Icons.Plain.SeparatorRight != "" {
+			p.SeparatorRight = configuration.Icons.Plain.SeparatorRight
+		}
+		if configuration.Icons.Plain.StagedModified != "" {
+			p.StagedModified = configuration.Icons.Plain.StagedModified
+		}
+		if configuration.Icons.Plain.StagedRemoved != "" {
+			p.StagedRemoved = configuration.Icons.Plain.StagedRemoved
+		}
+		if configuration.Icons.Plain.Stale != "" {
+			p.Stale = configuration.Icons.Plain.Stale
+		}
+		if configuration.Icons.Plain.Stashed != "" {
+			p.Stashed = configuration.Icons.Plain.Stashed
+		}
+		if configuration.Icons.Plain.Submodule != "" {
+			p.Submodule = configuration.Icons.Plain.Submodule
+		}
 		if configuration.Icons.Plain.Untracked != "" {
 			p.Untracked = configuration.Icons.Plain.Untracked
 		}
+		if configuration.Icons.Plain.Worktree != "" {
+			p.Worktree = configuration.Icons.Plain.Worktree
+		}
 	}
-	cwd, cwdParts := getCurrentWorkingDir()
+	p.SetColourDepth(powerline.DetectColourDepth(os.Getenv("TERM"), os.Getenv("COLORTERM"), os.Getenv("NO_COLOR") != ""))
+
+	p.Right = right
+	p.ConnectorTop = configuration.ConnectorTop
+	p.ConnectorBottom = configuration.ConnectorBottom
 
-	if term, found := syscall.Getenv("TERM"); found {
+	if term, found := syscall.Getenv("TERM"); found && !right {
 		if strings.Contains(term, "xterm") || strings.Contains(term, "rxvt") {
 			set_title = p.SetTitle
 		}
 	}
 
-	if configuration.ShowVirtualEnv {
-		p.AppendSegment(addVirtulEnvName(configuration, getVirtualEnv()))
-	}
-	if _, found := syscall.Getenv("SSH_CLIENT"); found {
-		p.AppendSegment(addHostname(configuration, true, true, p))
-	}
-	if configuration.ShowCwd {
-		parts := addCwd(configuration, cwdParts, p)
-		for _, element := range parts {
-			p.AppendSegment(&element)
+	cwd := getCurrentWorkingDir()
+	ctx, cancel := promptContext(configuration)
+	// a copy, as late providers may still be reading it once p has the segments
+	icons := p
+	shared := &powerline.Context{
+		Ctx:        ctx,
+		Config:     configuration,
+		RawConfig:  data,
+		Cwd:        cwd,
+		Repository: discoverRepository(cwd, repositoryCeilings(configuration)),
+		LookupEnv:  os.LookupEnv,
+		Powerline:  &icons,
+		Right:      right,
+		ReturnCode: last_retcode,
+		PipeStatus: pipestatus,
+		Duration:   duration,
+	}
+
+	// the segments are independent of each other so they're built
+	// concurrently, anything not done by the deadline is left out
+	var providers []segmentProvider
+	for _, provider := range powerline.Providers() {
+		if provider.Enabled(shared) && onSide(configuration, provider.Name(), right) {
+			providers = append(providers, bindProvider(shared, provider))
+		}
+	}
+	providers = selectProviders(providers, pending, func(name string) []powerline.Segment {
+		// nothing is coming outside of a repository
+		if shared.Repository == nil || shared.Repository.Kind != name {
+			return nil
 		}
+		return single(addPending(configuration, name, icons))
+	})
+
+	p.Segments = evaluateSegments(ctx, providers)
+	cancel()
+
+	if !right && p.Dollar != "" {
+		p.AppendSegment(addDollarPrompt(configuration, p.Dollar))
 	}
-	if configuration.ShowWritable {
-		p.AppendSegment(addLock(configuration, cwd, p))
-	}
-	if configuration.ShowGit {
-		porcelain, err := exec.Command("git", "status", "--ignore-submodules", "-b", "--porcelain").Output()
-		if err == nil {
-			p.AppendSegment(addGitInfo(configuration, string(porcelain), p))
+	if configuration.MaxWidth > 0 {
+		if columns := TerminalWidth(); columns > 0 {
+			p.FitWidth(int(float64(columns) * configuration.MaxWidth))
 		}
 	}
-	if configuration.ShowHg {
-		p.AppendSegment(addHgInfo(configuration, p))
-	}
-	if configuration.ShowReturnCode {
-		p.AppendSegment(addReturnCode(configuration, last_retcode))
+	// just the segments asked for, with the separators either side of them
+	// so they can be swapped into a prompt drawn without them
+	if len(only) > 0 {
+		fmt.Print(p.PrintSpan(only...))
+		return
 	}
-	if configuration.BatteryWarn > 0 {
-		p.AppendSegment(addBatteryWarn(configuration))
+	if right {
+		fmt.Print(p.PrintSegments())
+		return
 	}
-	p.AppendSegment(addDollarPrompt(configuration, p.Dollar))
 
 	fmt.Print(set_title, p.PrintSegments(), " ")
 }
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/scottweston/powerline-shell-go/powerline"
 	"github.com/scottweston/powerline-shell-go/powerline-config"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
 	"os/user"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test_addHostname_with_username(t *testing.T) {
@@ -56,16 +67,19 @@ func Test_addVirtualEnvName_present(t *testing.T) {
 func Test_addGitInfo_no_status(t *testing.T) {
 	var conf config.Configuration
 
-	var porc string = `## master...origin/master
+	var porc string = `# branch.oid 4b825dc642cb6eb9a060e54bf8d69288fbee4904
+# branch.head master
+# branch.upstream origin/master
+# branch.ab +0 -0
 `
 
 	p := powerline.NewPowerline("bash", false)
 
 	conf.SetDefaults()
-	rootSegment := addGitInfo(conf, porc, p)
+	rootSegment := addGitInfo(conf, parseGitStatus(porc), p)
 
 	var parts []powerline.Part
-	parts = append(parts, powerline.Part{Text: "master", Dirty: true})
+	parts = append(parts, powerline.Part{Text: "master", Dirty: true, Shrink: true})
 	want := powerline.Segment{Foreground: conf.Colours.Git.Text,
 		Background: conf.Colours.Git.BackgroundDefault,
 		Parts:      parts}
@@ -78,25 +92,28 @@ func Test_addGitInfo_no_status(t *testing.T) {
 func Test_addGitInfo_not_staged(t *testing.T) {
 	var conf config.Configuration
 
-	var porc string = `## master...origin/master
- M modifed.go
-A  added.go
-D  deleted.go
-DD conflicted.go
-?? not_staged.go
+	var porc string = `# branch.oid 4b825dc642cb6eb9a060e54bf8d69288fbee4904
+# branch.head master
+# branch.upstream origin/master
+# branch.ab +0 -0
+1 .M N... 100644 100644 100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 modifed.go
+1 A. N... 000000 100644 100644 0000000000000000000000000000000000000000 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 added.go
+1 D. N... 100644 000000 000000 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 0000000000000000000000000000000000000000 deleted.go
+u DD N... 100644 000000 000000 000000 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 0000000000000000000000000000000000000000 0000000000000000000000000000000000000000 conflicted.go
+? not_staged.go
 `
 
 	p := powerline.NewPowerline("bash", false)
 
 	conf.SetDefaults()
-	rootSegment := addGitInfo(conf, porc, p)
+	rootSegment := addGitInfo(conf, parseGitStatus(porc), p)
 
 	var parts []powerline.Part
-	parts = append(parts, powerline.Part{Text: "master", Dirty: true})
+	parts = append(parts, powerline.Part{Text: "master", Dirty: true, Shrink: true})
 	parts = append(parts, powerline.Part{Text: p.Added, Dirty: true})
+	parts = append(parts, powerline.Part{Text: p.StagedRemoved, Dirty: true})
 	parts = append(parts, powerline.Part{Text: p.Modified, Dirty: true})
 	parts = append(parts, powerline.Part{Text: p.Untracked, Dirty: true})
-	parts = append(parts, powerline.Part{Text: "2" + p.Removed, Dirty: true})
 	parts = append(parts, powerline.Part{Text: p.Conflicted, Dirty: true})
 	want := powerline.Segment{Foreground: conf.Colours.Git.Text,
 		Background: conf.Colours.Git.BackgroundChanges,
@@ -120,7 +137,7 @@ func Test_addCwd_root(t *testing.T) {
 
 	var parts []powerline.Part
 	var want []powerline.Segment
-	parts = append(parts, powerline.Part{Text: "/", Dirty: true})
+	parts = append(parts, powerline.Part{Text: "/", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      parts})
@@ -143,7 +160,7 @@ func Test_addCwd_root_one(t *testing.T) {
 
 	var parts []powerline.Part
 	var want []powerline.Segment
-	parts = append(parts, powerline.Part{Text: "/gocode", Dirty: true})
+	parts = append(parts, powerline.Part{Text: "/gocode", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      parts})
@@ -166,8 +183,8 @@ func Test_addCwd_root_two(t *testing.T) {
 
 	var parts []powerline.Part
 	var want []powerline.Segment
-	parts = append(parts, powerline.Part{Text: "/gocode", Dirty: true})
-	parts = append(parts, powerline.Part{Text: "src", Dirty: true})
+	parts = append(parts, powerline.Part{Text: "/gocode", Dirty: true, Shrink: true})
+	parts = append(parts, powerline.Part{Text: "src", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      parts})
@@ -190,9 +207,9 @@ func Test_addCwd_root_three(t *testing.T) {
 
 	var parts []powerline.Part
 	var want []powerline.Segment
-	parts = append(parts, powerline.Part{Text: "/gocode", Dirty: true})
+	parts = append(parts, powerline.Part{Text: "/gocode", Dirty: true, Shrink: true})
 	parts = append(parts, powerline.Part{Text: p.Ellipsis, Dirty: false})
-	parts = append(parts, powerline.Part{Text: "github.com", Dirty: true})
+	parts = append(parts, powerline.Part{Text: "github.com", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      parts})
@@ -243,7 +260,7 @@ func Test_addCwd_home_one(t *testing.T) {
 		Background: conf.Colours.Cwd.HomeBackground,
 		Parts:      parts})
 	var subparts []powerline.Part
-	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true})
+	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      subparts})
@@ -271,8 +288,8 @@ func Test_addCwd_home_two(t *testing.T) {
 		Background: conf.Colours.Cwd.HomeBackground,
 		Parts:      parts})
 	var subparts []powerline.Part
-	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true})
-	subparts = append(subparts, powerline.Part{Text: "src", Dirty: true})
+	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true, Shrink: true})
+	subparts = append(subparts, powerline.Part{Text: "src", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      subparts})
@@ -300,9 +317,9 @@ func Test_addCwd_home_three(t *testing.T) {
 		Background: conf.Colours.Cwd.HomeBackground,
 		Parts:      parts})
 	var subparts []powerline.Part
-	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true})
+	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true, Shrink: true})
 	subparts = append(subparts, powerline.Part{Text: p.Ellipsis})
-	subparts = append(subparts, powerline.Part{Text: "github.com", Dirty: true})
+	subparts = append(subparts, powerline.Part{Text: "github.com", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      subparts})
@@ -330,9 +347,9 @@ func Test_addCwd_home_five(t *testing.T) {
 		Background: conf.Colours.Cwd.HomeBackground,
 		Parts:      parts})
 	var subparts []powerline.Part
-	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true})
+	subparts = append(subparts, powerline.Part{Text: "gocode", Dirty: true, Shrink: true})
 	subparts = append(subparts, powerline.Part{Text: p.Ellipsis})
-	subparts = append(subparts, powerline.Part{Text: "power…ll-go", Dirty: true})
+	subparts = append(subparts, powerline.Part{Text: "power…ll-go", Dirty: true, Shrink: true})
 	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
 		Background: conf.Colours.Cwd.Background,
 		Parts:      subparts})
@@ -342,4 +359,1730 @@ func Test_addCwd_home_five(t *testing.T) {
 	}
 }
 
+func Test_PrintSegments_fish(t *testing.T) {
+	p := powerline.NewPowerline("fish", false)
+
+	segment := powerline.Segment{Foreground: 15, Background: 31}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "$HOME`", Dirty: true})
+	p.AppendSegment(&segment)
+
+	want := "\033[38;5;15m\033[48;5;31m $HOME` \033[0m\033[38;5;31m\033[0m"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(fish) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_PrintSegments_bash(t *testing.T) {
+	p := powerline.NewPowerline("bash", false)
+
+	segment := powerline.Segment{Foreground: 15, Background: 31}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "$(rm)`!&", Dirty: true})
+	p.AppendSegment(&segment)
+
+	want := "\\[\\e[38;5;15m\\]\\[\\e[48;5;31m\\] \\$(rm)\\`\\!\\& \\[\\e[0m\\]\\[\\e[38;5;31m\\]\\[\\e[0m\\]"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(bash) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_PrintSegments_zsh(t *testing.T) {
+	p := powerline.NewPowerline("zsh", false)
+
+	segment := powerline.Segment{Foreground: 15, Background: 31}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "$HOME", Dirty: true})
+	p.AppendSegment(&segment)
+
+	want := "%{\033[38;5;15m%}%{\033[48;5;31m%} \\$HOME %{%k%f%}%{\033[38;5;31m%}%{%k%f%}"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(zsh) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_PrintSegments_ansi(t *testing.T) {
+	p := powerline.NewPowerline("ansi", false)
+
+	segment := powerline.Segment{Foreground: 15, Background: 31}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "$HOME#1", Dirty: true})
+	p.AppendSegment(&segment)
+
+	want := "\033[38;5;15m\033[48;5;31m $HOME#1 \033[0m\033[38;5;31m\033[0m"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(ansi) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+	if p.Dollar != "" {
+		t.Errorf("ansi target has a dollar prompt: %q", p.Dollar)
+	}
+}
+
+func Test_PrintSegments_tmux(t *testing.T) {
+	p := powerline.NewPowerline("tmux", false)
+
+	segment := powerline.Segment{Foreground: 15, Background: 31}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "#(reboot)$", Dirty: true})
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "#", Dirty: false})
+	p.AppendSegment(&segment)
+
+	want := "#[fg=colour15]#[bg=colour31] ##(reboot)$ #[bg=colour31]#[fg=colour15]/" +
+		"#[fg=colour15]#[bg=colour31] # #[default]#[fg=colour31]#[default]"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(tmux) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_ParseColour(t *testing.T) {
+	tests := []struct {
+		in   string
+		want powerline.Colour
+	}{
+		{`31`, 31},
+		{`"31"`, 31},
+		{`"#1e1e2e"`, powerline.RGB(0x1e, 0x1e, 0x2e)},
+		{`"#FFF"`, powerline.RGB(255, 255, 255)},
+		{`"rgb(30, 30, 46)"`, powerline.RGB(30, 30, 46)},
+	}
+	for _, test := range tests {
+		var got powerline.Colour
+		if err := json.Unmarshal([]byte(test.in), &got); err != nil {
+			t.Errorf("Unmarshal(%s) failed: %s", test.in, err)
+		} else if got != test.want {
+			t.Errorf("Unmarshal(%s) returned %x not %x", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{`256`, `"#12345"`, `"rgb(1,2,300)"`, `"red"`} {
+		var got powerline.Colour
+		if err := json.Unmarshal([]byte(in), &got); err == nil {
+			t.Errorf("Unmarshal(%s) should have failed, returned %x", in, got)
+		}
+	}
+}
+
+func Test_Color_truecolour(t *testing.T) {
+	p := powerline.NewPowerline("ansi", false)
+	colour := powerline.RGB(0x1e, 0x1e, 0x2e)
+
+	p.Depth = powerline.TrueColours
+	if got := p.ForegroundColor(colour); got != "\033[38;2;30;30;46m" {
+		t.Errorf("ForegroundColor with truecolor returned %q", got)
+	}
+
+	// falls back to the nearest palette entry, a dark grey
+	p.Depth = powerline.Colours256
+	if got := p.BackgroundColor(colour); got != "\033[48;5;235m" {
+		t.Errorf("BackgroundColor without truecolor returned %q", got)
+	}
+
+	tmux := powerline.NewPowerline("tmux", false)
+	tmux.Depth = powerline.TrueColours
+	if got := tmux.BackgroundColor(colour); got != "#[bg=#1e1e2e]" {
+		t.Errorf("tmux BackgroundColor with truecolor returned %q", got)
+	}
+}
+
+func Test_Palette256(t *testing.T) {
+	tests := []struct {
+		in   powerline.Colour
+		want powerline.Colour
+	}{
+		{31, 31},
+		{powerline.RGB(0, 0, 0), 16},
+		{powerline.RGB(255, 255, 255), 231},
+		{powerline.RGB(255, 0, 0), 196},
+		{powerline.RGB(0x80, 0x80, 0x80), 244},
+	}
+	for _, test := range tests {
+		if got := test.in.Palette256(); got != test.want {
+			t.Errorf("Palette256(%x) returned %d not %d", test.in, got, test.want)
+		}
+	}
+}
+
+func Test_DetectColourDepth(t *testing.T) {
+	tests := []struct {
+		term      string
+		colorterm string
+		noColor   bool
+		want      powerline.ColourDepth
+	}{
+		{"xterm-256color", "", false, powerline.Colours256},
+		{"xterm-256color", "truecolor", false, powerline.TrueColours},
+		{"xterm-256color", "truecolor", true, powerline.NoColour},
+		{"linux", "", false, powerline.Colours16},
+		{"xterm-color", "", false, powerline.Colours16},
+		{"vt100", "", false, powerline.NoColour},
+		{"vt220-8bit", "", false, powerline.NoColour},
+		{"vte", "", false, powerline.Colours256},
+		{"vte-256color", "", false, powerline.Colours256},
+		{"vt100-color", "", false, powerline.Colours16},
+		{"dumb", "", false, powerline.NoColour},
+		{"xterm", "", false, powerline.Colours256},
+		{"xterm-direct", "", false, powerline.TrueColours},
+		{"kitty-direct", "", false, powerline.TrueColours},
+		{"xterm-direct", "", true, powerline.NoColour},
+	}
+	for _, test := range tests {
+		got := powerline.DetectColourDepth(test.term, test.colorterm, test.noColor)
+		if got != test.want {
+			t.Errorf("DetectColourDepth(%q, %q, %v) returned %d not %d", test.term, test.colorterm, test.noColor, got, test.want)
+		}
+	}
+}
+
+func Test_PrintSegments_16_colours(t *testing.T) {
+	p := powerline.NewPowerline("ansi", false)
+	p.SetColourDepth(powerline.Colours16)
+
+	// 196 is a bright red, 16 is black
+	segment := powerline.Segment{Foreground: 16, Background: 196}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "1", Dirty: false})
+	p.AppendSegment(&segment)
+
+	want := "\033[30m\033[101m 1 \033[0m\033[91m\033[0m"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(16 colours) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_PrintSegments_no_colour(t *testing.T) {
+	p := powerline.NewPowerline("bash", false)
+	p.SetColourDepth(powerline.NoColour)
+
+	for _, text := range []string{"~", "src"} {
+		segment := powerline.Segment{Foreground: 15, Background: 31}
+		segment.Parts = append(segment.Parts, powerline.Part{Text: text, Dirty: true})
+		p.AppendSegment(&segment)
+	}
+
+	want := " ~ > src >"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(no colour) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_PrintSegments_right(t *testing.T) {
+	p := powerline.NewPowerline("zsh", true)
+	p.Right = true
+
+	first := powerline.Segment{Foreground: 16, Background: 196, Weight: 10}
+	first.Parts = append(first.Parts, powerline.Part{Text: "130", Dirty: false})
+	second := powerline.Segment{Foreground: 15, Background: 31}
+	second.Parts = append(second.Parts, powerline.Part{Text: "host", Weight: 1, Dirty: true})
+	second.Parts = append(second.Parts, powerline.Part{Text: "user", Dirty: true})
+	p.AppendSegment(&second)
+	p.AppendSegment(&first)
+
+	want := "%{%k%f%}%{\033[38;5;196m%}\ue0b2%{\033[38;5;16m%}%{\033[48;5;196m%} 130 " +
+		"%{\033[48;5;196m%}%{\033[38;5;31m%}\ue0b2%{\033[38;5;15m%}%{\033[48;5;31m%} host " +
+		"\ue0b3%{\033[38;5;15m%}%{\033[48;5;31m%} user %{%k%f%}"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(right) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_PrintSegments_right_bash(t *testing.T) {
+	p := powerline.NewPowerline("bash", false)
+	p.Right = true
+
+	segment := powerline.Segment{Foreground: 16, Background: 196}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "130", Dirty: false})
+	p.AppendSegment(&segment)
+
+	// " 130 " is five cells wide, plain mode has no separator
+	want := "\\[\\e7\\e[999C\\e[4D\\e[0m\\e[38;5;196m\\e[38;5;16m\\e[48;5;196m 130 \\e[0m\\e8\\]"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(right bash) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+
+	p.Segments = nil
+	if got := p.PrintSegments(); got != "" {
+		t.Errorf("PrintSegments(right bash) without segments returned %q", got)
+	}
+}
+
+func Test_onSide(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.RightSegments = []string{"returncode", "battery"}
+
+	if !onSide(conf, "returncode", true) || onSide(conf, "returncode", false) {
+		t.Errorf("returncode should only be on the right")
+	}
+	if onSide(conf, "cwd", true) || !onSide(conf, "cwd", false) {
+		t.Errorf("cwd should only be on the left")
+	}
+}
+
+func Test_PrintSegments_multi_line(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.MultiLine = true
+
+	p := powerline.NewPowerline("zsh", false)
+	p.ConnectorTop = "╭─"
+	p.ConnectorBottom = "╰─"
+
+	segment := powerline.Segment{Foreground: 15, Background: 31}
+	segment.Parts = append(segment.Parts, powerline.Part{Text: "~", Dirty: true})
+	p.AppendSegment(&segment)
+	p.AppendSegment(addDollarPrompt(conf, p.Dollar))
+
+	want := "╭─%{\033[38;5;15m%}%{\033[48;5;31m%} ~ %{%k%f%}%{\033[38;5;31m%}%{%k%f%}\n" +
+		"╰─%{\033[38;5;15m%}%{\033[48;5;240m%} %# %{%k%f%}%{\033[38;5;240m%}%{%k%f%}"
+	got := p.PrintSegments()
+
+	if got != want {
+		t.Errorf("PrintSegments(multi line) returned:\n  %q\nnot:\n  %q", got, want)
+	}
+}
+
+func Test_FitWidth(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.Weights.Segments.Virtualenv = -10
+	conf.Weights.Segments.Returncode = -5
+
+	build := func() powerline.Powerline {
+		p := powerline.NewPowerline("bash", false)
+		p.AppendSegment(addVirtulEnvName(conf, "venv"))
+		for _, segment := range addCwd(conf, strings.Split("/gocode/src/powerline-shell-go", "/"), p) {
+			p.AppendSegment(&segment)
+		}
+		p.AppendSegment(addReturnCode(conf, 1))
+		p.AppendSegment(addDollarPrompt(conf, p.Dollar))
+		return p
+	}
+
+	// " venv " " /gocode / … / power…ll-go " " 1 " " \$ "
+	p := build()
+	if got := p.Width(); got != 40 {
+		t.Fatalf("Width returned %d not 40", got)
+	}
+
+	// the cwd shrinks before anything is dropped
+	p.FitWidth(36)
+	if got := p.Width(); got != 36 {
+		t.Errorf("FitWidth(36) left a width of %d", got)
+	}
+	if len(p.Segments) != 4 {
+		t.Errorf("FitWidth(36) dropped segments: %+v", p.Segments)
+	}
+	if got := p.Segments[0].Parts[2].Text; got != "pow…-go" {
+		t.Errorf("FitWidth(36) shrunk the cwd to %q", got)
+	}
+
+	// then the lowest weights are dropped, never the prompt
+	p = build()
+	p.FitWidth(20)
+	var texts []string
+	for _, segment := range p.Segments {
+		texts = append(texts, segment.Parts[0].Text)
+	}
+	if want := []string{"/…e", "\\$"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("FitWidth(20) left %q not %q", texts, want)
+	}
+
+	p = build()
+	p.FitWidth(1)
+	if len(p.Segments) != 1 || !p.Segments[0].Keep {
+		t.Errorf("FitWidth(1) didn't keep only the prompt: %+v", p.Segments)
+	}
+}
+
+func Test_TextWidth(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"gocode", 6},
+		{"café", 4},
+		{"cafe\u0301", 4},
+		{"日本語", 6},
+		{"ｆｕｌｌ", 8},
+		{"🚀", 2},
+		{"👍🏽", 2},
+		{"👨‍👩‍👧", 2},
+		{"🇦🇺🇳🇿", 4},
+		{"❤️", 2},
+		{"…", 1},
+	}
+	for _, test := range tests {
+		if got := powerline.TextWidth(test.in); got != test.want {
+			t.Errorf("TextWidth(%q) returned %d not %d", test.in, got, test.want)
+		}
+	}
+}
+
+func Test_Truncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"powerline-shell-go", 12, "power…ll-go"},
+		{"short", 12, "short"},
+		{"ünïcödé-dïrëctöry", 12, "ünïcö…ctöry"},
+		{"cafe\u0301-cafe\u0301-cafe\u0301", 8, "caf…afe\u0301"},
+		{"日本語のディレクトリ名", 12, "日本…リ名"},
+		{"日本語のディレクトリ名", 10, "日本…リ名"},
+		{"🚀🚀🚀rocket🚀🚀🚀", 10, "🚀🚀…🚀🚀"},
+		{"👨‍👩‍👧👨‍👩‍👧👨‍👩‍👧👨‍👩‍👧", 6, "👨‍👩‍👧…👨‍👩‍👧"},
+		{"🇦🇺🇳🇿🇬🇧🇺🇸", 6, "🇦🇺…🇺🇸"},
+		{"hostname", 2, "hostname"},
+	}
+	for _, test := range tests {
+		if got := powerline.Truncate(test.in, test.max, "…"); got != test.want {
+			t.Errorf("Truncate(%q, %d) returned %q not %q", test.in, test.max, got, test.want)
+		}
+		if got := powerline.Truncate(test.in, test.max, "…"); powerline.TextWidth(got) > test.max && got != test.in {
+			t.Errorf("Truncate(%q, %d) returned %q, %d cells wide", test.in, test.max, got, powerline.TextWidth(got))
+		}
+	}
+}
+
+func Test_addCwd_wide(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+
+	p := powerline.NewPowerline("bash", false)
+
+	dir := "/プロジェクト/ソースコード置き場"
+	cwdparts := strings.Split(dir, "/")
+
+	rootSegments := addCwd(conf, cwdparts, p)
+
+	var parts []powerline.Part
+	var want []powerline.Segment
+	parts = append(parts, powerline.Part{Text: "/プロジェクト", Dirty: true, Shrink: true})
+	parts = append(parts, powerline.Part{Text: "ソー…き場", Dirty: true, Shrink: true})
+	want = append(want, powerline.Segment{Foreground: conf.Colours.Cwd.Text,
+		Background: conf.Colours.Cwd.Background,
+		Parts:      parts})
+
+	if !reflect.DeepEqual(rootSegments, want) {
+		t.Errorf("addCwd_wide returned:\n  %+v\nnot:\n  %+v", rootSegments, want)
+	}
+}
+
+func Test_addDuration(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0", ""},
+		{"4.9", ""},
+		{"12345ms", "12.3s"},
+		{"12345678us", "12.3s"},
+		{"124s", "2m04s"},
+		{"3720", "1h02m"},
+	}
+	for _, test := range tests {
+		duration, err := parseDuration(test.in)
+		if err != nil {
+			t.Errorf("parseDuration(%q) failed: %s", test.in, err)
+			continue
+		}
+		segment := addDuration(conf, duration)
+		if test.want == "" {
+			if segment != nil {
+				t.Errorf("addDuration(%s) returned %+v not nil", duration, segment)
+			}
+			continue
+		}
+		if segment == nil {
+			t.Errorf("addDuration(%s) returned nil", duration)
+		} else if segment.Parts[0].Text != test.want {
+			t.Errorf("addDuration(%s) returned %q not %q", duration, segment.Parts[0].Text, test.want)
+		}
+	}
+
+	if _, err := parseDuration("soon"); err == nil {
+		t.Errorf("parseDuration(soon) should have failed")
+	}
+}
+
+func Test_addPipeStatus(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"0,0,0", ""},
+		{"0,1,0", "0|1|0"},
+		{"1 0", "1|0"},
+		{"2,0,1", "2|0|1"},
+	}
+	for _, test := range tests {
+		codes, err := parsePipeStatus(test.in)
+		if err != nil {
+			t.Errorf("parsePipeStatus(%q) failed: %s", test.in, err)
+			continue
+		}
+		segment := addPipeStatus(conf, codes)
+		if test.want == "" {
+			if segment != nil {
+				t.Errorf("addPipeStatus(%v) returned %+v not nil", codes, segment)
+			}
+			continue
+		}
+		var parts []powerline.Part
+		parts = append(parts, powerline.Part{Text: test.want, Dirty: false})
+		want := powerline.Segment{Foreground: conf.Colours.Returncode.Text,
+			Background: conf.Colours.Returncode.Background,
+			Parts:      parts}
+		if !reflect.DeepEqual(segment, &want) {
+			t.Errorf("addPipeStatus(%v) returned:\n  %+v\nnot:\n  %+v", codes, segment, &want)
+		}
+	}
+
+	if _, err := parsePipeStatus("0,x"); err == nil {
+		t.Errorf("parsePipeStatus(0,x) should have failed")
+	}
+}
+
+func Test_addReturnCode_signals(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+
+	tests := []struct {
+		format string
+		codes  []int
+		want   string
+		signal bool
+	}{
+		{"both", []int{1}, "1", false},
+		{"both", []int{126}, "126 NOEXEC", false},
+		{"both", []int{127}, "127 NOTFOUND", false},
+		{"both", []int{130}, "130 INT", true},
+		{"name", []int{137}, "KILL", true},
+		{"number", []int{139}, "139", true},
+		{"name", []int{0, 141}, "0|PIPE", true},
+		{"name", []int{255}, "255", false},
+	}
+	for _, test := range tests {
+		conf.ReturnCodeFormat = test.format
+		segment := addPipeStatus(conf, test.codes)
+		if segment == nil {
+			t.Errorf("addPipeStatus(%v) returned nil", test.codes)
+			continue
+		}
+		if segment.Parts[0].Text != test.want {
+			t.Errorf("addPipeStatus(%v) as %s returned %q not %q", test.codes, test.format, segment.Parts[0].Text, test.want)
+		}
+		if killed := segment.Background == conf.Colours.Returncode.SignalBackground; killed != test.signal {
+			t.Errorf("addPipeStatus(%v) used the signal colours: %v", test.codes, killed)
+		}
+	}
+}
+
+// gitRepoFixture runs git commands in a scratch repository, skipping the
+// test when git isn't installed. Commands prefixed with "!" may fail
+func gitRepoFixture(t *testing.T) (string, func(args ...string)) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	run := func(args ...string) {
+		may_fail := strings.HasPrefix(args[0], "!")
+		cmd := exec.Command("git", append([]string{strings.TrimPrefix(args[0], "!")}, args[1:]...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com", "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil && !may_fail {
+			t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	run("init", "-q", "-b", "main")
+	return dir, run
+}
+
+func Test_nativeGitStatus(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	write := func(name string, text string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the native reader should agree with git, it doesn't look at
+	// untracked or staged files so there aren't any here
+	check := func(what string) {
+		t.Helper()
+		var conf config.Configuration
+		conf.SetDefaults()
+		want, err := readGitStatus(context.Background(), conf, dir)
+		if err != nil {
+			t.Fatalf("%s: git status failed: %s", what, err)
+		}
+		got, err := nativeGitStatus(context.Background(), dir, false)
+		if err != nil {
+			t.Fatalf("%s: nativeGitStatus failed: %s", what, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: nativeGitStatus returned:\n  %+v\nnot:\n  %+v", what, got, want)
+		}
+	}
+
+	check("empty")
+
+	write("a", "one\n")
+	write("b", "two\n")
+	git("add", "a", "b")
+	git("commit", "-q", "-m", "first")
+	check("first commit")
+
+	// an upstream that has moved on while we've committed locally
+	git("branch", "upstream")
+	git("branch", "--set-upstream-to=upstream")
+	write("a", "one\nmore\n")
+	git("commit", "-q", "-am", "local")
+	git("checkout", "-q", "upstream")
+	write("b", "two\nmore\n")
+	git("commit", "-q", "-am", "remote 1")
+	write("b", "two\nmore\nagain\n")
+	git("commit", "-q", "-am", "remote 2")
+	git("checkout", "-q", "main")
+	check("diverged")
+
+	status, _ := nativeGitStatus(context.Background(), dir, false)
+	if status.Ahead != 1 || status.Behind != 2 || status.Upstream != "upstream" {
+		t.Errorf("nativeGitStatus returned %+v, not ahead 1 and behind 2 of upstream", status)
+	}
+
+	// the same from packed objects and refs
+	git("gc", "-q")
+	check("packed")
+
+	write("a", "changed\n")
+	os.Remove(filepath.Join(dir, "b"))
+	check("modified and deleted")
+	git("checkout", "-q", "--", "a", "b")
+
+	// staged changes, including in a directory the cache tree knows about
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	write("sub/c", "three\n")
+	git("add", "sub/c")
+	git("commit", "-q", "-m", "sub")
+	write("a", "staged\n")
+	write("new", "new\n")
+	git("add", "a", "new")
+	git("rm", "-q", "b")
+	write("a", "staged and then some\n")
+	check("staged")
+	git("reset", "-q", "--hard")
+
+	git("checkout", "-q", "--detach", "HEAD~1")
+	check("detached")
+}
+
+func Test_nativeGitStatus_conflicts(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("base\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "base")
+	git("checkout", "-q", "-b", "other")
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("other\n"), 0644)
+	git("commit", "-q", "-am", "other")
+	git("checkout", "-q", "main")
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("main\n"), 0644)
+	git("commit", "-q", "-am", "main")
+	git("!merge", "-q", "other")
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	want, _ := readGitStatus(context.Background(), conf, dir)
+	got, err := nativeGitStatus(context.Background(), dir, false)
+	if err != nil {
+		t.Fatalf("nativeGitStatus failed: %s", err)
+	}
+	if got.Conflicted != 1 || !reflect.DeepEqual(got, want) {
+		t.Errorf("nativeGitStatus returned:\n  %+v\nnot:\n  %+v", got, want)
+	}
+}
+
+func Test_addGitInfo_diverged(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.Weights.Parts.Ahead = 5
+	conf.Weights.Parts.Sync = 3
+
+	porc := `# branch.oid 4b825dc642cb6eb9a060e54bf8d69288fbee4904
+# branch.head main
+# branch.upstream origin/main
+# branch.ab +2 -3
+`
+	p := powerline.NewPowerline("bash", false)
+	status := parseGitStatus(porc)
+	if status.Branch != "main" || status.Upstream != "origin/main" || status.Ahead != 2 || status.Behind != 3 {
+		t.Errorf("parseGitStatus returned %+v", status)
+	}
+
+	want := powerline.Parts{
+		{Text: p.Branch + " main", Dirty: true, Shrink: true},
+		{Text: "2" + p.Ahead, Weight: 5, Dirty: true},
+		{Text: "3" + p.Behind, Weight: 3, Dirty: true},
+	}
+	if segment := addGitInfo(conf, status, p); !reflect.DeepEqual(segment.Parts, want) {
+		t.Errorf("addGitInfo returned:\n  %+v\nnot:\n  %+v", segment.Parts, want)
+	}
+}
+
+func Test_gitOperation(t *testing.T) {
+	dir := t.TempDir()
+	if op := gitOperation(dir); op != "" {
+		t.Errorf("gitOperation returned %q with nothing in progress", op)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "MERGE_HEAD"), []byte("x\n"), 0644)
+	if op := gitOperation(dir); op != "MERGING" {
+		t.Errorf("gitOperation returned %q, not MERGING", op)
+	}
+
+	// rebases take precedence and show how far along they are
+	os.Mkdir(filepath.Join(dir, "rebase-merge"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "rebase-merge", "msgnum"), []byte("3\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "rebase-merge", "end"), []byte("7\n"), 0644)
+	if op := gitOperation(dir); op != "REBASE 3/7" {
+		t.Errorf("gitOperation returned %q, not REBASE 3/7", op)
+	}
+}
+
+func Test_addGitInfo_rebase(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("base\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "base")
+	git("checkout", "-q", "-b", "topic")
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("topic\n"), 0644)
+	git("commit", "-q", "-am", "topic 1")
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("topic\n"), 0644)
+	git("add", "b")
+	git("commit", "-q", "-m", "topic 2")
+	git("checkout", "-q", "main")
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("main\n"), 0644)
+	git("commit", "-q", "-am", "main")
+	git("checkout", "-q", "topic")
+	git("!rebase", "-q", "--merge", "main")
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.Weights.Parts.Operation = 10
+	p := powerline.NewPowerline("bash", false)
+
+	for _, backend := range []string{"exec", "native"} {
+		conf.GitBackend = backend
+		status, err := readGitStatus(context.Background(), conf, dir)
+		if err != nil {
+			t.Fatalf("%s: readGitStatus failed: %s", backend, err)
+		}
+		want := powerline.Part{Text: p.Operation + " REBASE 1/2", Weight: 10, Dirty: true}
+		segment := addGitInfo(conf, status, p)
+		if len(segment.Parts) < 2 || !reflect.DeepEqual(segment.Parts[1], want) {
+			t.Errorf("%s: addGitInfo returned:\n  %+v\nwithout:\n  %+v", backend, segment.Parts, want)
+		}
+	}
+}
+
+func Test_addGitInfo_stash(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("base\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "base")
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.Weights.Parts.Stashed = -5
+	p := powerline.NewPowerline("bash", false)
+
+	for i, want := range []string{p.Stashed, "2" + p.Stashed} {
+		ioutil.WriteFile(filepath.Join(dir, "a"), []byte(strings.Repeat("change\n", i+1)), 0644)
+		git("stash", "-q")
+
+		for _, backend := range []string{"exec", "native"} {
+			conf.GitBackend = backend
+			status, _ := readGitStatus(context.Background(), conf, dir)
+			segment := addGitInfo(conf, status, p)
+			last := segment.Parts[len(segment.Parts)-1]
+			if status.Stashed != i+1 || last != (powerline.Part{Text: want, Weight: -5, Dirty: true}) {
+				t.Errorf("%s: addGitInfo returned %+v for %d stash entries", backend, segment.Parts, i+1)
+			}
+		}
+	}
+}
+
+func Test_addGitInfo_staged(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.Weights.Parts.StagedModified = 4
+
+	porc := `# branch.oid 4b825dc642cb6eb9a060e54bf8d69288fbee4904
+# branch.head main
+1 M. N... 100644 100644 100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 a.go
+1 M. N... 100644 100644 100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 b.go
+`
+	p := powerline.NewPowerline("bash", false)
+
+	// only staged changes get their own colour
+	segment := addGitInfo(conf, parseGitStatus(porc), p)
+	want := powerline.Parts{
+		{Text: p.Branch + " main", Dirty: true, Shrink: true},
+		{Text: "2" + p.StagedModified, Weight: 4, Dirty: true},
+	}
+	if segment.Background != conf.Colours.Git.BackgroundStaged || !reflect.DeepEqual(segment.Parts, want) {
+		t.Errorf("addGitInfo returned:\n  %+v\nnot:\n  %+v", segment.Parts, want)
+	}
+
+	// a file modified again after staging is in both
+	porc = strings.Replace(porc, "1 M. N...", "1 MM N...", 1)
+	segment = addGitInfo(conf, parseGitStatus(porc), p)
+	want = append(want, powerline.Part{Text: p.Modified, Dirty: true})
+	if segment.Background != conf.Colours.Git.BackgroundChanges || !reflect.DeepEqual(segment.Parts, want) {
+		t.Errorf("addGitInfo returned:\n  %+v\nnot:\n  %+v", segment.Parts, want)
+	}
+}
+
+func Test_addGitInfo_detached(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	commit := func(text string) {
+		ioutil.WriteFile(filepath.Join(dir, "a"), []byte(text), 0644)
+		git("add", "a")
+		git("commit", "-q", "-m", text)
+	}
+	commit("one")
+	git("tag", "v1-light")
+	git("tag", "-a", "-m", "release", "v1.0.0")
+	commit("two")
+	git("tag", "light")
+	commit("three")
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.ShaLength = 10
+	p := powerline.NewPowerline("bash", false)
+
+	branch := func() powerline.Part {
+		status, err := readGitStatus(context.Background(), conf, dir)
+		if err != nil {
+			t.Fatalf("readGitStatus failed: %s", err)
+		}
+		return addGitInfo(conf, status, p).Parts[0]
+	}
+
+	for _, packed := range []bool{false, true} {
+		if packed {
+			git("pack-refs", "--all")
+		}
+		for _, backend := range []string{"exec", "native"} {
+			conf.GitBackend = backend
+
+			// annotated tags win over lightweight ones
+			git("checkout", "-q", "--detach", "main~2")
+			if got := branch(); got.Text != p.Detached+" v1.0.0" || !got.Shrink {
+				t.Errorf("%s, packed %v: detached at an annotated tag showed %+v", backend, packed, got)
+			}
+			git("checkout", "-q", "--detach", "main~1")
+			if got := branch(); got.Text != p.Detached+" light" {
+				t.Errorf("%s, packed %v: detached at a lightweight tag showed %+v", backend, packed, got)
+			}
+
+			// otherwise the abbreviated commit
+			git("checkout", "-q", "--detach", "main")
+			status, _ := readGitStatus(context.Background(), conf, dir)
+			if got := branch(); got.Text != p.Detached+" "+status.Oid[:10] || got.Shrink {
+				t.Errorf("%s, packed %v: detached without a tag showed %+v", backend, packed, got)
+			}
+		}
+	}
+}
+
+func Test_readGitStatus_locations(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "base")
+
+	// a repository to use as a submodule
+	lib := filepath.Join(dir, "..", filepath.Base(dir)+"-lib")
+	git("init", "-q", "-b", "main", lib)
+	ioutil.WriteFile(filepath.Join(lib, "l"), []byte("l\n"), 0644)
+	git("-C", lib, "add", "l")
+	git("-C", lib, "commit", "-q", "-m", "lib")
+	git("-c", "protocol.file.allow=always", "submodule", "-q", "add", lib, "lib")
+	git("commit", "-q", "-m", "add lib")
+
+	git("worktree", "add", "-q", "-b", "feature", filepath.Join(dir, "..", filepath.Base(dir)+"-feature"))
+	git("clone", "-q", "--bare", dir, filepath.Join(dir, "..", filepath.Base(dir)+"-bare"))
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	p := powerline.NewPowerline("bash", false)
+
+	for _, backend := range []string{"exec", "native"} {
+		conf.GitBackend = backend
+		tests := []struct {
+			path string
+			want powerline.Part
+		}{
+			{filepath.Join(dir, "lib"), powerline.Part{Text: p.Submodule + " " + filepath.Base(dir), Dirty: true}},
+			{filepath.Join(dir, "..", filepath.Base(dir)+"-feature"), powerline.Part{Text: p.Worktree + " " + filepath.Base(dir) + "-feature", Dirty: true}},
+			{filepath.Join(dir, "..", filepath.Base(dir)+"-bare"), powerline.Part{Text: p.GitDir + " bare"}},
+			{filepath.Join(dir, ".git", "refs"), powerline.Part{Text: p.GitDir + " git dir"}},
+		}
+		for _, test := range tests {
+			status, err := readGitStatus(context.Background(), conf, test.path)
+			if err != nil {
+				t.Errorf("%s: readGitStatus(%s) failed: %s", backend, test.path, err)
+				continue
+			}
+			parts := addGitInfo(conf, status, p).Parts
+			if len(parts) < 2 || !reflect.DeepEqual(parts[1], test.want) {
+				t.Errorf("%s: addGitInfo(%s) returned:\n  %+v\nwithout:\n  %+v", backend, test.path, parts, test.want)
+			}
+		}
+
+		// dirty submodules only count when asked to
+		ioutil.WriteFile(filepath.Join(dir, "lib", "l"), []byte("changed\n"), 0644)
+		for _, dirty := range []bool{false, true} {
+			conf.SubmodulesDirty = dirty
+			status, _ := readGitStatus(context.Background(), conf, dir)
+			if status.Dirty() != dirty || (dirty && status.Modified != 1) {
+				t.Errorf("%s: submodulesDirty %v gave %+v", backend, dirty, status)
+			}
+		}
+		conf.SubmodulesDirty = false
+		git("-C", filepath.Join(dir, "lib"), "checkout", "-q", "--", "l")
+	}
+}
+
+func Test_readGitStatus_uninitializedSubmodule(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	lib := filepath.Join(dir, "..", filepath.Base(dir)+"-lib")
+	git("init", "-q", "-b", "main", lib)
+	ioutil.WriteFile(filepath.Join(lib, "l"), []byte("l\n"), 0644)
+	git("-C", lib, "add", "l")
+	git("-C", lib, "commit", "-q", "-m", "lib")
+	git("-c", "protocol.file.allow=always", "submodule", "-q", "add", lib, "lib")
+	git("commit", "-q", "-m", "add lib")
+
+	// a clone leaves the submodule as an empty directory
+	clone := filepath.Join(dir, "..", filepath.Base(dir)+"-clone")
+	git("clone", "-q", dir, clone)
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.SubmodulesDirty = true
+	for _, backend := range []string{"exec", "native"} {
+		conf.GitBackend = backend
+		if status, err := readGitStatus(context.Background(), conf, clone); err != nil || status.Dirty() {
+			t.Errorf("%s: readGitStatus returned %+v (%v) not a clean repository", backend, status, err)
+		}
+	}
+}
+
+func Test_addGitInfo_branches(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	err := json.Unmarshal([]byte(`{"branches": ["main", "trunk", {"pattern": "release/*", "background": "#ff0000", "text": 15}]}`), &conf)
+	if err != nil {
+		t.Fatalf("unmarshalling branches failed: %s", err)
+	}
+	p := powerline.NewPowerline("bash", false)
+
+	tests := []struct {
+		status     gitStatus
+		text       string
+		background powerline.Colour
+		foreground powerline.Colour
+	}{
+		{gitStatus{Branch: "main"}, "main", conf.Colours.Git.BackgroundDefault, conf.Colours.Git.Text},
+		{gitStatus{Branch: "master"}, p.Branch + " master", conf.Colours.Git.BackgroundDefault, conf.Colours.Git.Text},
+		{gitStatus{Branch: "release/1.2"}, p.Branch + " release/1.2", powerline.RGB(255, 0, 0), 15},
+		// changes still show on a coloured branch
+		{gitStatus{Branch: "release/1.2", Modified: 1}, p.Branch + " release/1.2", conf.Colours.Git.BackgroundChanges, 15},
+		{gitStatus{Branch: "release/1.2", Added: 1}, p.Branch + " release/1.2", conf.Colours.Git.BackgroundStaged, 15},
+		// detection only counts when it's enabled
+		{gitStatus{Branch: "develop", Primary: "develop"}, p.Branch + " develop", conf.Colours.Git.BackgroundDefault, conf.Colours.Git.Text},
+	}
+	for _, test := range tests {
+		segment := addGitInfo(conf, test.status, p)
+		if segment.Parts[0].Text != test.text || segment.Background != test.background || segment.Foreground != test.foreground {
+			t.Errorf("addGitInfo(%s) returned %+v", test.status.Branch, segment)
+		}
+	}
+
+	conf.DetectPrimaryBranch = true
+	if segment := addGitInfo(conf, gitStatus{Branch: "develop", Primary: "develop"}, p); segment.Parts[0].Text != "develop" {
+		t.Errorf("addGitInfo didn't treat the detected branch as primary: %+v", segment)
+	}
+}
+
+func Test_readGitStatus_remoteHead(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "base")
+	git("branch", "-q", "-m", "trunk")
+
+	clone := filepath.Join(dir, "..", filepath.Base(dir)+"-clone")
+	git("clone", "-q", dir, clone)
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	for _, backend := range []string{"exec", "native"} {
+		conf.GitBackend = backend
+		if status, _ := readGitStatus(context.Background(), conf, clone); status.Primary != "trunk" {
+			t.Errorf("%s: readGitStatus found %q as origin's HEAD, not trunk", backend, status.Primary)
+		}
+	}
+}
+
+func Test_readGitStatus_timeout(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "base")
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("changed\n"), 0644)
+
+	// a git that hangs, with a child that keeps its output open
+	bin := t.TempDir()
+	ioutil.WriteFile(filepath.Join(bin, "git"), []byte("#!/bin/sh\nsleep 10 &\nexec sleep 10\n"), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.VcsTimeout = 0.1
+	p := powerline.NewPowerline("bash", false)
+
+	for _, backend := range []string{"exec", "native"} {
+		conf.GitBackend = backend
+		ctx, cancel := vcsContext(context.Background(), conf)
+		if backend == "native" {
+			// the native reader is quick, so give it no time at all
+			cancel()
+		}
+		start := time.Now()
+		status, err := readGitStatus(ctx, conf, dir)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: readGitStatus failed: %s", backend, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: readGitStatus took %s", backend, elapsed)
+		}
+
+		want := powerline.Parts{
+			{Text: p.Branch + " main", Dirty: true, Shrink: true},
+			{Text: p.Stale},
+		}
+		segment := addGitInfo(conf, status, p)
+		if segment.Background != conf.Colours.Git.BackgroundDefault || !reflect.DeepEqual(segment.Parts, want) {
+			t.Errorf("%s: addGitInfo returned:\n  %+v\nnot:\n  %+v", backend, segment.Parts, want)
+		}
+	}
+}
+
+func Test_readGitStatus_noUntracked(t *testing.T) {
+	dir, _ := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644)
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	if status, _ := readGitStatus(context.Background(), conf, dir); status.Untracked != 1 {
+		t.Errorf("readGitStatus found %d untracked files, not 1", status.Untracked)
+	}
+
+	conf.NoUntracked = []string{filepath.Join(filepath.Dir(dir), "*")}
+	if status, _ := readGitStatus(context.Background(), conf, dir); status.Untracked != 0 {
+		t.Errorf("readGitStatus found %d untracked files with noUntracked set", status.Untracked)
+	}
+}
+
+func Test_evaluateSegments_order(t *testing.T) {
+	// equal weights so only the collection order decides
+	segment := func(text string, weight int) powerline.Segment {
+		return powerline.Segment{Foreground: 15, Background: 0, Weight: weight, Parts: powerline.Parts{{Text: text}}}
+	}
+	segments := []powerline.Segment{segment("a", 0), segment("b", 0), segment("c", 5), segment("d", 0)}
+
+	render := func(delays []int) string {
+		var providers []segmentProvider
+		for i, s := range segments {
+			s, delay := s, time.Duration(delays[i])*time.Millisecond
+			providers = append(providers, segmentProvider{s.Parts[0].Text, func(ctx context.Context) []powerline.Segment {
+				time.Sleep(delay)
+				return []powerline.Segment{s}
+			}})
+		}
+		p := powerline.NewPowerline("bash", false)
+		p.Segments = evaluateSegments(context.Background(), providers)
+		return p.PrintSegments()
+	}
+
+	want := render([]int{0, 0, 0, 0})
+	for _, delays := range [][]int{{30, 20, 10, 0}, {0, 30, 10, 20}, {10, 0, 30, 20}} {
+		if got := render(delays); got != want {
+			t.Errorf("finishing after %v ms rendered:\n  %q\nnot:\n  %q", delays, got, want)
+		}
+	}
+
+	// by weight and then in provider order
+	var providers []segmentProvider
+	for _, s := range segments {
+		s := s
+		providers = append(providers, segmentProvider{s.Parts[0].Text, func(ctx context.Context) []powerline.Segment {
+			return []powerline.Segment{s}
+		}})
+	}
+	var order string
+	for _, s := range evaluateSegments(context.Background(), providers) {
+		order += s.Parts[0].Text
+	}
+	if order != "cabd" {
+		t.Errorf("evaluateSegments collected %s, not cabd", order)
+	}
+}
+
+func Test_evaluateSegments_deadline(t *testing.T) {
+	quick := segmentProvider{"quick", func(ctx context.Context) []powerline.Segment {
+		return []powerline.Segment{{Parts: powerline.Parts{{Text: "quick"}}}}
+	}}
+	slow := segmentProvider{"slow", func(ctx context.Context) []powerline.Segment {
+		time.Sleep(time.Second)
+		return []powerline.Segment{{Parts: powerline.Parts{{Text: "slow"}}}}
+	}}
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.PromptTimeout = 0.05
+	ctx, cancel := promptContext(conf)
+	defer cancel()
+
+	start := time.Now()
+	segments := evaluateSegments(ctx, []segmentProvider{slow, quick})
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("evaluateSegments waited %s for a late segment", elapsed)
+	}
+	if len(segments) != 1 || segments[0].Parts[0].Text != "quick" {
+		t.Errorf("evaluateSegments returned %+v, not just the quick segment", segments)
+	}
+}
+
+func Test_discoverRepository(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	t.Setenv("GIT_DIR", "")
+	t.Setenv("GIT_CEILING_DIRECTORIES", "")
+
+	for _, dir := range []string{"git/.git/objects", "git/src/hg/.hg", "git/src/hg/lib", "svn/.svn", "svn/trunk", "plain"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(root, "git", ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644)
+
+	tests := []struct {
+		dir      string
+		ceilings []string
+		want     *powerline.Repository
+	}{
+		{"git/src", nil, &powerline.Repository{Kind: "git", Root: filepath.Join(root, "git")}},
+		{"git/.git", nil, &powerline.Repository{Kind: "git", Root: filepath.Join(root, "git", ".git")}},
+		{"git/src/hg/lib", nil, &powerline.Repository{Kind: "hg", Root: filepath.Join(root, "git", "src", "hg")}},
+		{"svn/trunk", nil, &powerline.Repository{Kind: "svn", Root: filepath.Join(root, "svn")}},
+		{"plain", nil, nil},
+		// never walk up into a ceiling, but the cwd itself is looked at
+		{"git/src", []string{filepath.Join(root, "git")}, nil},
+		{"git", []string{filepath.Join(root, "git")}, &powerline.Repository{Kind: "git", Root: filepath.Join(root, "git")}},
+	}
+	for _, test := range tests {
+		repo := discoverRepository(filepath.Join(root, test.dir), test.ceilings)
+		if !reflect.DeepEqual(repo, test.want) {
+			t.Errorf("discoverRepository(%s, %v) returned %+v not %+v", test.dir, test.ceilings, repo, test.want)
+		}
+	}
+
+	t.Setenv("GIT_CEILING_DIRECTORIES", "relative:"+filepath.Join(root, "git"))
+	ceilings := repositoryCeilings(config.Configuration{CeilingDirectories: []string{root + "/svn/"}})
+	if want := []string{filepath.Join(root, "git"), filepath.Join(root, "svn")}; !reflect.DeepEqual(ceilings, want) {
+		t.Errorf("repositoryCeilings returned %v not %v", ceilings, want)
+	}
+	if repo := discoverRepository(filepath.Join(root, "svn", "trunk"), ceilings); repo != nil {
+		t.Errorf("discoverRepository(svn/trunk) returned %+v not nil", repo)
+	}
+	if _, err := findGitRepo(filepath.Join(root, "git", "src")); err == nil {
+		t.Error("findGitRepo walked past GIT_CEILING_DIRECTORIES")
+	}
+}
+
+func Test_repoRelativeParts(t *testing.T) {
+	tests := []struct {
+		cwd  string
+		want []string
+	}{
+		{"/src/proj", []string{"proj"}},
+		{"/src/proj/lib/util", []string{"proj", "lib", "util"}},
+		{"/src/project", nil},
+	}
+	for _, test := range tests {
+		if parts := repoRelativeParts(test.cwd, "/src/proj"); !reflect.DeepEqual(parts, test.want) {
+			t.Errorf("repoRelativeParts(%s) returned %q not %q", test.cwd, parts, test.want)
+		}
+	}
+
+	conf := config.Configuration{}
+	conf.SetDefaults()
+	conf.CwdMaxLength = 0
+	p := powerline.NewPowerline("bash", false)
+	segments := addCwd(conf, repoRelativeParts("/src/proj/lib/util", "/src/proj"), p)
+	want := powerline.Parts{{Text: "proj", Dirty: true, Shrink: true}, {Text: p.Ellipsis}, {Text: "util", Dirty: true, Shrink: true}}
+	if len(segments) != 1 || !reflect.DeepEqual(segments[0].Parts, want) {
+		t.Errorf("addCwd returned %+v not %+v", segments, want)
+	}
+}
+
+func Test_daemon(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("node_modules/\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "node_modules", "pkg"), 0755)
+	git("add", "a", ".gitignore")
+	git("commit", "-q", "-m", "first")
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.DaemonTimeout = 1
+	d, err := newDaemon(conf)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	listener, err := net.Listen("unix", daemonSocket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go d.serve(listener)
+
+	repo := discoverRepository(dir, nil)
+	if _, err := askDaemon(conf, repo); err != errNoDaemon {
+		t.Fatalf("askDaemon returned %v before the first probe not %v", err, errNoDaemon)
+	}
+	// the daemon probes in the background, so the answers come later
+	waitFor := func(what string, check func(gitStatus) bool) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if cached, err := askDaemon(conf, repo); err == nil && check(*cached.Git) {
+				return
+			}
+		}
+		t.Fatalf("the daemon never reported %s", what)
+	}
+	waitFor("a clean repository", func(status gitStatus) bool {
+		return status.Branch == "main" && !status.Dirty()
+	})
+
+	// ignored directories aren't watched
+	ioutil.WriteFile(filepath.Join(dir, "node_modules", "pkg", "index.js"), []byte("\n"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	d.mutex.Lock()
+	entry := d.entries["git:"+repo.Root]
+	d.mutex.Unlock()
+	if entry == nil || !entry.ready {
+		t.Errorf("the daemon dropped the repository for a change in an ignored directory")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("b\n"), 0644)
+	waitFor("the modified file", func(status gitStatus) bool {
+		return status.Modified == 1
+	})
+	git("commit", "-q", "-a", "-m", "second")
+	waitFor("the commit", func(status gitStatus) bool {
+		return !status.Dirty()
+	})
+
+	conf.Daemon = false
+	if _, err := askDaemon(conf, repo); err != errNoDaemon {
+		t.Errorf("askDaemon returned %v with the daemon disabled not %v", err, errNoDaemon)
+	}
+}
+
+func Test_daemon_entries(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	d, err := newDaemon(conf)
+	if err != nil {
+		t.Skip(err)
+	}
+	entry := func(key string) daemonEntry {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if entry := d.entries[key]; entry != nil {
+			return *entry
+		}
+		return daemonEntry{}
+	}
+	waitFor := func(key string, backoff time.Duration) {
+		t.Helper()
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if e := entry(key); e.failed && e.backoff == backoff {
+				return
+			}
+		}
+		t.Fatalf("%s never failed with a backoff of %s: %+v", key, backoff, entry(key))
+	}
+
+	// somewhere that can't be cached is remembered, and only tried again
+	// once its backoff has passed
+	request := daemonRequest{Kind: "git", Root: filepath.Join(t.TempDir(), "missing")}
+	key := "git:" + request.Root
+	d.lookup(request)
+	waitFor(key, daemonRetry)
+	retry := entry(key).retry
+	d.lookup(request)
+	if e := entry(key); !e.failed || e.retry != retry {
+		t.Errorf("lookup probed %s again before its retry time: %+v", key, e)
+	}
+	d.mutex.Lock()
+	d.entries[key].retry = time.Now().Add(-time.Second)
+	d.mutex.Unlock()
+	d.lookup(request)
+	waitFor(key, 2*daemonRetry)
+
+	// the least recently used entry makes way for a new one
+	d.mutex.Lock()
+	for i := 0; len(d.entries) < daemonMaxEntries; i++ {
+		d.entries[fmt.Sprintf("git:/%d", i)] = &daemonEntry{failed: true, retry: time.Now().Add(time.Hour), used: time.Now()}
+	}
+	d.entries[key].used = time.Now().Add(-time.Hour)
+	d.mutex.Unlock()
+	d.lookup(daemonRequest{Kind: "git", Root: request.Root + "2"})
+	d.mutex.Lock()
+	_, found := d.entries[key]
+	count := len(d.entries)
+	d.mutex.Unlock()
+	if found || count != daemonMaxEntries {
+		t.Errorf("lookup left %d entries, including %s: %v, not %d without it", count, key, found, daemonMaxEntries)
+	}
+}
+
+func Test_selectProviders(t *testing.T) {
+	provider := func(name string) segmentProvider {
+		return segmentProvider{name, func(ctx context.Context) []powerline.Segment {
+			return []powerline.Segment{{Parts: powerline.Parts{{Text: name}}}}
+		}}
+	}
+	providers := []segmentProvider{provider("cwd"), provider("git"), provider("returncode")}
+	placeholder := func(name string) []powerline.Segment {
+		return []powerline.Segment{{Parts: powerline.Parts{{Text: name + "..."}}}}
+	}
+	texts := func(selected []segmentProvider) []string {
+		var texts []string
+		for _, segment := range evaluateSegments(context.Background(), selected) {
+			texts = append(texts, segment.Parts[0].Text)
+		}
+		return texts
+	}
+
+	tests := []struct {
+		pending []string
+		want    []string
+	}{
+		{nil, []string{"cwd", "git", "returncode"}},
+		{[]string{"git"}, []string{"cwd", "git...", "returncode"}},
+		{[]string{"git", "hg"}, []string{"cwd", "git...", "returncode"}},
+	}
+	for _, test := range tests {
+		if selected := texts(selectProviders(providers, test.pending, placeholder)); !reflect.DeepEqual(selected, test.want) {
+			t.Errorf("selectProviders(%v) returned %v not %v", test.pending, selected, test.want)
+		}
+	}
+}
+
+func Test_addPending(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	p := powerline.NewPowerline("bash", false)
+
+	status := parseGitStatus("# branch.oid 1234567890123456789012345678901234567890\n# branch.head master\n")
+	git := addGitInfo(conf, status, p)
+	pending := addPending(conf, "git", p)
+	// the placeholder takes the place of a clean repository
+	if pending.Background != git.Background || pending.Foreground != git.Foreground || pending.Weight != git.Weight {
+		t.Errorf("addPending() = %+v, doesn't match %+v", pending, git)
+	}
+	if want := (powerline.Parts{{Text: p.Pending, Weight: conf.Weights.Parts.Branch}}); !reflect.DeepEqual(pending.Parts, want) {
+		t.Errorf("addPending() parts = %+v, want %+v", pending.Parts, want)
+	}
+	if segment := addPending(conf, "cwd", p); segment != nil {
+		t.Errorf("addPending(cwd) = %+v, want nil", segment)
+	}
+}
+
+func Test_registry(t *testing.T) {
+	names := func() []string {
+		var names []string
+		for _, provider := range powerline.Providers() {
+			names = append(names, provider.Name())
+		}
+		return names
+	}
+	builtin := []string{"virtualenv", "hostname", "cwd", "lock", "git", "hg", "returncode", "duration", "battery"}
+	if registered := names(); !reflect.DeepEqual(registered, builtin) {
+		t.Fatalf("Providers returned %v not %v", registered, builtin)
+	}
+	// the registry is shared with the rest of the tests, so it's put back
+	// as it was, in the same order
+	saved := powerline.Providers()
+	t.Cleanup(func() {
+		for _, provider := range powerline.Providers() {
+			powerline.Unregister(provider.Name())
+		}
+		for _, provider := range saved {
+			powerline.Register(provider)
+		}
+	})
+
+	var conf config.Configuration
+	conf.SetDefaults()
+	shared := &powerline.Context{
+		Ctx:       context.Background(),
+		Config:    conf,
+		RawConfig: []byte(`{"showCwd": true, "deploy": {"target": "staging"}}`),
+		Cwd:       "/",
+		LookupEnv: func(key string) (string, bool) { return "", false },
+	}
+	deploy := powerline.NewProvider("deploy", nil, func(ctx *powerline.Context) []powerline.Segment {
+		var options struct {
+			Target string `json:"target"`
+		}
+		if err := ctx.Option("deploy", &options); err != nil {
+			t.Error(err)
+		}
+		return []powerline.Segment{{Parts: powerline.Parts{{Text: options.Target}}}}
+	})
+	if !deploy.Enabled(shared) {
+		t.Error("a provider without an enabled check is disabled")
+	}
+	if segments := deploy.Build(shared); segments[0].Parts[0].Text != "staging" {
+		t.Errorf("deploy returned %+v not the staging target", segments)
+	}
+	if hostname := powerline.Providers()[1]; hostname.Enabled(shared) {
+		t.Error("the hostname segment is enabled outside of ssh")
+	}
+
+	// registering a name again replaces it in place
+	powerline.Register(deploy)
+	powerline.Register(powerline.NewProvider("cwd", nil, deploy.Build))
+	if registered, want := names(), append(append([]string{}, builtin...), "deploy"); !reflect.DeepEqual(registered, want) {
+		t.Errorf("Providers returned %v not %v", registered, want)
+	}
+	if segments := powerline.Providers()[2].Build(shared); segments[0].Parts[0].Text != "staging" {
+		t.Errorf("cwd wasn't replaced, it returned %+v", segments)
+	}
+
+	powerline.Unregister("hostname")
+	if registered := names(); len(registered) != len(builtin) || registered[1] != "cwd" {
+		t.Errorf("Providers returned %v after unregistering hostname", registered)
+	}
+}
+
+func Test_installSnippet(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  string
+	}{
+		{"bash", `export PROMPT_COMMAND="_update_ps1; $PROMPT_COMMAND`},
+		{"zsh", "precmd_functions+=(powerline_precmd)"},
+		{"fish", "function fish_prompt; powerline-shell-go fish $status"},
+		{"tmux", `set -g status-left "#(cd '#{pane_current_path}' && powerline-shell-go tmux 0`},
+		{"ksh", "echo Unsupported shell: ksh;"},
+	}
+	for _, test := range tests {
+		if got := installSnippet(test.shell); !strings.Contains(got, test.want) {
+			t.Errorf("installSnippet(%s) returned:\n  %s\nwithout:\n  %s", test.shell, got, test.want)
+		}
+	}
+}
+
+func Test_main_install(t *testing.T) {
+	// run as the command itself by the test below
+	if args := os.Getenv("POWERLINE_SHELL_GO_ARGS"); args != "" {
+		os.Args = append([]string{"powerline-shell-go"}, strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+
+	tests := []struct {
+		args    string
+		install bool
+	}{
+		{"fish install", true},
+		{"fish 0 install", true},
+		{"bash 1 install", true},
+		{"zsh 0 install", true},
+		{"tmux 0 install", true},
+		{"fish 0", false},
+		{"bash 1", false},
+	}
+	for _, test := range tests {
+		shell := strings.Fields(test.args)[0]
+		cmd := exec.Command(os.Args[0], "-test.run=^Test_main_install$")
+		cmd.Env = append(os.Environ(), "POWERLINE_SHELL_GO_ARGS="+test.args)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("%s failed: %s", test.args, err)
+			continue
+		}
+		if got := strings.Contains(string(out), installSnippet(shell)); got != test.install {
+			t.Errorf("%s printed:\n  %s\nwhich is the install snippet: %v not %v", test.args, out, got, test.install)
+		}
+	}
+}
+
+func Test_nativeGitStatus_contents(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	file := filepath.Join(dir, "a")
+	ioutil.WriteFile(file, []byte("one\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "first")
+
+	// touched but the same, and then made executable
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(file, later, later)
+	status, err := nativeGitStatus(context.Background(), dir, false)
+	if err != nil || status.Modified != 0 {
+		t.Errorf("nativeGitStatus returned %d modified (%v) for a touched file not 0", status.Modified, err)
+	}
+	os.Chmod(file, 0755)
+	status, err = nativeGitStatus(context.Background(), dir, false)
+	if err != nil || status.Modified != 1 {
+		t.Errorf("nativeGitStatus returned %d modified (%v) for an executable file not 1", status.Modified, err)
+	}
+	git("config", "core.fileMode", "false")
+	status, err = nativeGitStatus(context.Background(), dir, false)
+	if err != nil || status.Modified != 0 {
+		t.Errorf("nativeGitStatus returned %d modified (%v) without core.fileMode not 0", status.Modified, err)
+	}
+}
+
+func Test_nativeGitStatus_unsupported(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("one\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "first")
+
+	// cut off in the middle of an entry with extended flags
+	ioutil.WriteFile(filepath.Join(dir, "0"), []byte("zero\n"), 0644)
+	git("add", "-N", "0")
+	git("update-index", "--index-version", "3")
+	index := filepath.Join(dir, ".git", "index")
+	data, _ := ioutil.ReadFile(index)
+	repo, err := findGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.close()
+	for _, size := range []int{12 + 62, 12 + 63} {
+		ioutil.WriteFile(index, data[:size], 0644)
+		if _, err := repo.readIndex(); err == nil {
+			t.Errorf("readIndex returned no error for an index of %d bytes", size)
+		}
+	}
+	ioutil.WriteFile(index, data, 0644)
+	git("rm", "-q", "--cached", "0")
+
+	git("update-index", "--split-index")
+	if _, err := nativeGitStatus(context.Background(), dir, false); !errors.Is(err, errNativeUnsupported) {
+		t.Errorf("nativeGitStatus returned %v for a split index not %v", err, errNativeUnsupported)
+	}
+	var conf config.Configuration
+	conf.SetDefaults()
+	conf.GitBackend = "native"
+	if status, err := readGitStatus(context.Background(), conf, dir); err != nil || status.Branch != "main" {
+		t.Errorf("readGitStatus returned %+v (%v) for a split index not the branch from git", status, err)
+	}
+
+	sha256 := filepath.Join(dir, "sha256")
+	git("init", "-q", "--object-format=sha256", "-b", "main", sha256)
+	if _, err := nativeGitStatus(context.Background(), sha256, false); !errors.Is(err, errNativeUnsupported) {
+		t.Errorf("nativeGitStatus returned %v for a SHA-256 repository not %v", err, errNativeUnsupported)
+	}
+}
+
+func Test_branches_defaults(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	p := powerline.NewPowerline("bash", false)
+
+	tests := []struct {
+		vcs    string
+		branch string
+		text   string
+	}{
+		{"git", "master", "master"},
+		{"git", "default", p.Branch + " default"},
+		{"hg", "default", "default"},
+		{"hg", "master", p.Branch + " master"},
+	}
+	for _, test := range tests {
+		var segment *powerline.Segment
+		if test.vcs == "git" {
+			segment = addGitInfo(conf, gitStatus{Branch: test.branch}, p)
+		} else {
+			segment = addHgInfo(conf, "branch: "+test.branch+"\ncommit: (clean)\n", false, p)
+		}
+		if segment.Parts[0].Text != test.text {
+			t.Errorf("%s branch %s returned %q not %q", test.vcs, test.branch, segment.Parts[0].Text, test.text)
+		}
+	}
+}
+
+func Test_gitPack_badDelta(t *testing.T) {
+	// a pack header and two offset deltas, one based on itself and one on
+	// something before the start of the pack
+	name := filepath.Join(t.TempDir(), "pack")
+	ioutil.WriteFile(name, []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x02\x60\x00\x60\x7f"), 0644)
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	pack := &gitPack{pack: file, cache: map[int64]packObject{}}
+	for _, offset := range []int64{12, 14} {
+		if _, _, err := pack.readAt(&gitRepo{}, offset, 0); err == nil {
+			t.Errorf("readAt(%d) returned no error for a bad delta base", offset)
+		}
+	}
+}
+
+func Test_tagAt_corrupt(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "first")
+
+	// a loose tag object cut short, as a tag that should be skipped
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte("tag 10\x00object 12"))
+	zw.Close()
+	name := "0123456789012345678901234567890123456789"
+	os.MkdirAll(filepath.Join(dir, ".git", "objects", name[:2]), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".git", "objects", name[:2], name[2:]), buf.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".git", "refs", "tags", "broken"), []byte(name+"\n"), 0644)
+
+	repo, err := findGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.close()
+	_, head, err := repo.head()
+	if err != nil || head == nil {
+		t.Fatalf("head failed: %v", err)
+	}
+	if tag := repo.tagAt(*head); tag != "" {
+		t.Errorf("tagAt returned %q not no tag", tag)
+	}
+}
+
+func Test_branchRules(t *testing.T) {
+	var conf config.Configuration
+	conf.SetDefaults()
+	err := json.Unmarshal([]byte(`{"branches": [{"pattern": "release/*", "background": 160}, "main"]}`), &conf)
+	if err != nil {
+		t.Fatalf("unmarshalling branches failed: %s", err)
+	}
+	background := powerline.Colour(160)
+	want := []config.BranchRule{{Pattern: "release/*", Background: &background}, {Pattern: "main", Primary: true}}
+	if !reflect.DeepEqual(conf.Branches, want) {
+		t.Errorf("unmarshalling branches returned:\n  %+v\nnot:\n  %+v", conf.Branches, want)
+	}
+}
+
+func Test_main_segments(t *testing.T) {
+	dir, git := gitRepoFixture(t)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a\n"), 0644)
+	git("add", "a")
+	git("commit", "-q", "-m", "first")
+	// changes give the git segment other colours than its placeholder
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("b\n"), 0644)
+
+	home := t.TempDir()
+	prompt := func(args string) string {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], "-test.run=^Test_main_install$")
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "POWERLINE_SHELL_GO_ARGS="+args, "HOME="+home, "XDG_RUNTIME_DIR="+home)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s failed: %s", args, err)
+		}
+		return string(out)
+	}
+
+	// what the zsh snippet does, swapping the placeholder for the segment
+	fast := prompt("zsh 1 --pending=git,hg")
+	placeholder := prompt("zsh 1 --pending=git,hg --segments=git,hg")
+	text := prompt("zsh 1 --segments=git,hg")
+	full := prompt("zsh 1")
+	if placeholder == "" || !strings.Contains(fast, placeholder) {
+		t.Errorf("the placeholder %q isn't in the prompt:\n  %q", placeholder, fast)
+	}
+	if spliced := strings.Replace(fast, placeholder, text, 1); spliced != full {
+		t.Errorf("swapping in the segments returned:\n  %q\nnot:\n  %q", spliced, full)
+	}
+
+	// outside of a repository there's nothing to swap
+	dir = t.TempDir()
+	if text := prompt("zsh 1 --segments=git,hg"); text != "" {
+		t.Errorf("--segments=git,hg printed %q outside of a repository", text)
+	}
+}
+
+func Test_PrintSpan(t *testing.T) {
+	segments := func(background powerline.Colour, text string) powerline.Segments {
+		return powerline.Segments{
+			{Foreground: 1, Background: 2, Weight: 3, Parts: powerline.Parts{{Text: "cwd"}}, Provider: "cwd"},
+			{Foreground: 1, Background: background, Weight: 2, Parts: powerline.Parts{{Text: text}, {Text: "+1"}}, Provider: "git"},
+			{Foreground: 1, Background: 5, Weight: 1, Parts: powerline.Parts{{Text: "1"}}, Provider: "returncode"},
+		}
+	}
+	// not bash, its right prompt starts with its width
+	for _, shell := range []string{"zsh", "fish"} {
+		for _, right := range []bool{false, true} {
+			p := powerline.NewPowerline(shell, false)
+			p.Right = right
+			p.Segments = segments(3, "...")
+			pending, placeholder := p.PrintSegments(), p.PrintSpan("git", "hg")
+			p.Segments = segments(4, "main")
+			full, text := p.PrintSegments(), p.PrintSpan("git", "hg")
+			if placeholder == "" || strings.Replace(pending, placeholder, text, 1) != full {
+				t.Errorf("%s right %v: swapping %q for %q in:\n  %q\nisn't:\n  %q", shell, right, placeholder, text, pending, full)
+			}
+			if span := p.PrintSpan("battery"); span != "" {
+				t.Errorf("%s right %v: PrintSpan returned %q for a missing segment not nothing", shell, right, span)
+			}
+		}
+	}
+}
+
 // vim: ts=8 sw=8 smartindent noexpandtab:
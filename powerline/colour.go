@@ -0,0 +1,230 @@
+package powerline
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Colour is either an xterm-256 palette index (0-255) or a 24-bit colour
+// flagged with rgbFlag and packed as 0xRRGGBB in the low bits
+type Colour int
+
+const rgbFlag Colour = 1 << 24
+
+var reRGB = regexp.MustCompile(`^rgb\(\s*([0-9]{1,3})\s*,\s*([0-9]{1,3})\s*,\s*([0-9]{1,3})\s*\)$`)
+
+func RGB(r, g, b int) Colour {
+	return rgbFlag | Colour((r&0xff)<<16|(g&0xff)<<8|(b&0xff))
+}
+
+func (c Colour) IsRGB() bool {
+	return c&rgbFlag != 0
+}
+
+func (c Colour) RGB() (int, int, int) {
+	return int(c>>16) & 0xff, int(c>>8) & 0xff, int(c) & 0xff
+}
+
+// ParseColour accepts a palette index ("31"), a hex colour ("#1e1e2e" or
+// "#fff") or an rgb() triple ("rgb(30,30,46)")
+func ParseColour(s string) (Colour, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if strings.HasPrefix(s, "#") {
+		hex := s[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			return 0, fmt.Errorf("invalid hex colour %q", s)
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid hex colour %q", s)
+		}
+		return rgbFlag | Colour(v), nil
+	}
+
+	if m := reRGB.FindStringSubmatch(s); m != nil {
+		var rgb [3]int
+		for i := range rgb {
+			rgb[i], _ = strconv.Atoi(m[i+1])
+			if rgb[i] > 255 {
+				return 0, fmt.Errorf("invalid rgb colour %q", s)
+			}
+		}
+		return RGB(rgb[0], rgb[1], rgb[2]), nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 || v > 255 {
+		return 0, fmt.Errorf("invalid colour %q", s)
+	}
+	return Colour(v), nil
+}
+
+func (c *Colour) UnmarshalJSON(data []byte) error {
+	var v int
+	if err := json.Unmarshal(data, &v); err == nil {
+		if v < 0 || v > 255 {
+			return fmt.Errorf("invalid colour %d", v)
+		}
+		*c = Colour(v)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid colour %s", data)
+	}
+	parsed, err := ParseColour(s)
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// the 6x6x6 cube levels of the xterm-256 palette
+var cubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+func nearestCubeLevel(v int) int {
+	best := 0
+	for i, l := range cubeLevels {
+		if abs(v-l) < abs(v-cubeLevels[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+func distance(r1, g1, b1, r2, g2, b2 int) int {
+	return (r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Palette256 returns the nearest xterm-256 palette index, palette colours are
+// returned untouched
+func (c Colour) Palette256() Colour {
+	if !c.IsRGB() {
+		return c
+	}
+	r, g, b := c.RGB()
+
+	// closest colour from the 6x6x6 cube
+	ri, gi, bi := nearestCubeLevel(r), nearestCubeLevel(g), nearestCubeLevel(b)
+	cube := 16 + 36*ri + 6*gi + bi
+	cubeDist := distance(r, g, b, cubeLevels[ri], cubeLevels[gi], cubeLevels[bi])
+
+	// closest colour from the 24 step greyscale ramp
+	grey := (r + g + b) / 3
+	gi24 := 0
+	if grey > 238 {
+		gi24 = 23
+	} else if grey > 8 {
+		gi24 = (grey - 3) / 10
+	}
+	level := 8 + 10*gi24
+	greyDist := distance(r, g, b, level, level, level)
+
+	if greyDist < cubeDist {
+		return Colour(232 + gi24)
+	}
+	return Colour(cube)
+}
+
+// the xterm defaults for the 16 ANSI colours
+var ansiColours = [16][3]int{
+	{0x00, 0x00, 0x00}, {0xcd, 0x00, 0x00}, {0x00, 0xcd, 0x00}, {0xcd, 0xcd, 0x00},
+	{0x00, 0x00, 0xee}, {0xcd, 0x00, 0xcd}, {0x00, 0xcd, 0xcd}, {0xe5, 0xe5, 0xe5},
+	{0x7f, 0x7f, 0x7f}, {0xff, 0x00, 0x00}, {0x00, 0xff, 0x00}, {0xff, 0xff, 0x00},
+	{0x5c, 0x5c, 0xff}, {0xff, 0x00, 0xff}, {0x00, 0xff, 0xff}, {0xff, 0xff, 0xff},
+}
+
+// toRGB expands palette colours into their (approximate) 24-bit value
+func (c Colour) toRGB() (int, int, int) {
+	switch {
+	case c.IsRGB():
+		return c.RGB()
+	case c < 16:
+		return ansiColours[c][0], ansiColours[c][1], ansiColours[c][2]
+	case c < 232:
+		i := int(c) - 16
+		return cubeLevels[i/36], cubeLevels[(i/6)%6], cubeLevels[i%6]
+	default:
+		level := 8 + 10*(int(c)-232)
+		return level, level, level
+	}
+}
+
+// Palette16 returns the nearest of the 16 ANSI colours
+func (c Colour) Palette16() Colour {
+	if !c.IsRGB() && c < 16 {
+		return c
+	}
+	r, g, b := c.toRGB()
+
+	best := 0
+	bestDist := -1
+	for i, ansi := range ansiColours {
+		d := distance(r, g, b, ansi[0], ansi[1], ansi[2])
+		if bestDist < 0 || d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return Colour(best)
+}
+
+// ColourDepth is how many colours the terminal can show
+type ColourDepth int
+
+const (
+	NoColour ColourDepth = iota
+	Colours16
+	Colours256
+	TrueColours
+)
+
+// vtTerminals are the DEC terminals, which have no colour. Variants such as
+// vt100-am or vt220-8bit share the name before the dash
+var vtTerminals = map[string]bool{
+	"vt52": true, "vt100": true, "vt102": true, "vt125": true, "vt131": true, "vt132": true,
+	"vt200": true, "vt220": true, "vt320": true, "vt340": true, "vt400": true, "vt420": true,
+	"vt510": true, "vt520": true, "vt525": true,
+}
+
+// DetectColourDepth guesses the terminal's capabilities from $TERM,
+// $COLORTERM and whether $NO_COLOR is set, anything unknown is assumed to
+// handle 256 colours
+func DetectColourDepth(term string, colorterm string, noColor bool) ColourDepth {
+	if noColor || term == "dumb" {
+		return NoColour
+	}
+	// terminfo's *-direct entries, e.g. xterm-direct, are 24-bit
+	if colorterm == "truecolor" || colorterm == "24bit" || strings.HasSuffix(term, "-direct") {
+		return TrueColours
+	}
+
+	switch {
+	case strings.HasSuffix(term, "-mono") || strings.HasSuffix(term, "-m"):
+		return NoColour
+	case vtTerminals[strings.SplitN(term, "-", 2)[0]] && !strings.Contains(term, "color"):
+		return NoColour
+	case strings.Contains(term, "256color"):
+		return Colours256
+	case term == "linux" || term == "ansi" || term == "cons25" || term == "cygwin":
+		return Colours16
+	case strings.HasSuffix(term, "-16color") || strings.HasSuffix(term, "-color") || strings.HasSuffix(term, "-8color"):
+		return Colours16
+	}
+	return Colours256
+}
@@ -11,6 +11,7 @@ type Part struct {
 	Text   string
 	Weight int
 	Dirty  bool
+	Shrink bool
 }
 type Parts []Part
 
@@ -27,10 +28,14 @@ func (slice Parts) Swap(i, j int) {
 }
 
 type Segment struct {
-	Foreground int
-	Background int
+	Foreground Colour
+	Background Colour
 	Weight     int
+	NewLine    bool
+	Keep       bool
 	Parts      Parts
+	// the name of the provider that built it
+	Provider string
 }
 type Segments []Segment
 
@@ -47,44 +52,121 @@ func (slice Segments) Swap(i, j int) {
 }
 
 type Powerline struct {
-	ShTemplate    string
-	BashTemplate  string
-	ColorTemplate string
-	Reset         string
-	Separator     string
-	SeparatorThin string
-	Ellipsis      string
-	ReadOnly      string
-	Phases        string
-	Added         string
-	Modified      string
-	Untracked     string
-	Removed       string
-	Renamed       string
-	Detached      string
-	Attached      string
-	Branch        string
-	Ahead         string
-	Behind        string
-	Conflicted    string
-	Dollar        string
-	SetTitle      string
-	Bold          string
-	Segments      Segments
-}
-
-func (p *Powerline) Color(fore int, back int) string {
+	Shell              string
+	Depth              ColourDepth
+	ShTemplate         string
+	BashTemplate       string
+	ColorTemplate      string
+	Escape             string
+	EscapeWith         string
+	Reset              string
+	Separator          string
+	SeparatorThin      string
+	SeparatorRight     string
+	SeparatorRightThin string
+	Right              bool
+	ConnectorTop       string
+	ConnectorBottom    string
+	Ellipsis           string
+	ReadOnly           string
+	Phases             string
+	Added              string
+	Modified           string
+	Untracked          string
+	Removed            string
+	Renamed            string
+	Detached           string
+	Attached           string
+	Branch             string
+	Ahead              string
+	Behind             string
+	Conflicted         string
+	Operation          string
+	Pending            string
+	Stale              string
+	Stashed            string
+	StagedModified     string
+	StagedRemoved      string
+	Submodule          string
+	Worktree           string
+	GitDir             string
+	Dollar             string
+	SetTitle           string
+	Bold               string
+	Segments           Segments
+}
+
+func (p *Powerline) Color(layer int, colour Colour) string {
+	if p.Depth == NoColour {
+		return ""
+	}
 	return fmt.Sprintf(
 		p.ShTemplate,
-		fmt.Sprintf(p.ColorTemplate, fore, back),
+		fmt.Sprintf(p.ColorTemplate, p.colourSpec(layer, colour)),
 	)
 }
 
-func (p *Powerline) ForegroundColor(fore int) string {
+// colourSpec returns the attributes for a colour on the given layer (38 for
+// the foreground, 48 for the background) in the syntax of the output target.
+// Colours the terminal can't show fall back to the nearest one it can
+func (p *Powerline) colourSpec(layer int, colour Colour) string {
+	switch p.Depth {
+	case Colours16:
+		colour = colour.Palette16()
+	case Colours256:
+		colour = colour.Palette256()
+	}
+
+	if colour.IsRGB() {
+		r, g, b := colour.RGB()
+		if p.Shell == "tmux" {
+			if layer == 38 {
+				return fmt.Sprintf("fg=#%02x%02x%02x", r, g, b)
+			}
+			return fmt.Sprintf("bg=#%02x%02x%02x", r, g, b)
+		}
+		return fmt.Sprintf("%d;2;%d;%d;%d", layer, r, g, b)
+	}
+
+	if p.Shell == "tmux" {
+		if layer == 38 {
+			return fmt.Sprintf("fg=colour%d", colour)
+		}
+		return fmt.Sprintf("bg=colour%d", colour)
+	}
+
+	if p.Depth == Colours16 {
+		// 30-37/40-47 for the normal colours, 90-97/100-107 for the bright ones
+		code := layer - 8
+		if colour >= 8 {
+			code += 60
+			colour -= 8
+		}
+		return fmt.Sprintf("%d", code+int(colour))
+	}
+	return fmt.Sprintf("%d;5;%d", layer, colour)
+}
+
+// SetColourDepth limits the colours used to what the terminal supports.
+// Without any colour the segments are only told apart by their separators
+func (p *Powerline) SetColourDepth(depth ColourDepth) {
+	p.Depth = depth
+	if depth == NoColour {
+		p.Reset = ""
+		if p.Separator == "" {
+			p.Separator = ">"
+		}
+		if p.SeparatorRight == "" {
+			p.SeparatorRight = "<"
+		}
+	}
+}
+
+func (p *Powerline) ForegroundColor(fore Colour) string {
 	return p.Color(38, fore)
 }
 
-func (p *Powerline) BackgroundColor(back int) string {
+func (p *Powerline) BackgroundColor(back Colour) string {
 	return p.Color(48, back)
 }
 
@@ -94,19 +176,101 @@ func (p *Powerline) AppendSegment(segment *Segment) {
 	}
 }
 
+// escapeText returns a function that escapes dodgy shell injection
+// characters in dirty parts
+func (p *Powerline) escapeText() func(Part) string {
+	if p.Escape == "" {
+		return func(part Part) string { return part.Text }
+	}
+	re := regexp.MustCompile(p.Escape)
+	return func(part Part) string {
+		if part.Dirty {
+			return re.ReplaceAllString(part.Text, p.EscapeWith)
+		}
+		return part.Text
+	}
+}
+
 func (p *Powerline) PrintSegments() string {
+	if p.Right {
+		return p.printRightSegments()
+	}
+	text, _, _ := p.renderSegments()
+	return text
+}
+
+// PrintSpan renders the prompt but returns only what the segments of the
+// named providers draw, from the separator before the first of them to the
+// one after the last. As the separators take the colours of both sides the
+// span can be swapped for the same span of another rendering without
+// changing the rest of the prompt, except bash's right prompt which starts
+// with its width. It's empty when none of them are shown
+func (p *Powerline) PrintSpan(names ...string) string {
+	var text string
+	var starts, ends []int
+	if p.Right {
+		text, starts, ends = p.renderRightSegments()
+	} else {
+		text, starts, ends = p.renderSegments()
+	}
+
+	first, last := -1, -1
+	for i, segment := range p.Segments {
+		for _, name := range names {
+			if segment.Provider == name {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+	return text[starts[first]:ends[last]]
+}
+
+// renderSegments draws the left prompt, along with where each segment's
+// span starts and ends
+func (p *Powerline) renderSegments() (string, []int, []int) {
 	var buffer bytes.Buffer
 	var nextBackground string
 	var text string
+	starts := make([]int, len(p.Segments))
+	ends := make([]int, len(p.Segments))
+	// where the separator at the end of the previous segment starts
+	lead := 0
 
 	// sort segments
 	sort.Sort(p.Segments)
 
+	escape := p.escapeText()
+
+	// a multi-line prompt gets its connectors at the start of each line
+	for i := 1; i < len(p.Segments); i++ {
+		if p.Segments[i].NewLine {
+			buffer.WriteString(p.ConnectorTop)
+			break
+		}
+	}
+
 	for i, Seg := range p.Segments {
 
+		// close off the previous line before starting a new one
+		if i > 0 && Seg.NewLine {
+			buffer.WriteString(p.Reset + "\n" + p.ConnectorBottom)
+		}
+		if i == 0 || Seg.NewLine {
+			starts[i] = buffer.Len()
+		} else {
+			starts[i] = lead
+		}
+		lead = buffer.Len()
+
 		// What color do we need to end the segment, this last background is
 		// the next segments background
-		if (i + 1) == len(p.Segments) {
+		if (i+1) == len(p.Segments) || p.Segments[i+1].NewLine {
 			nextBackground = p.Reset
 		} else {
 			nextBackground = p.BackgroundColor(p.Segments[i+1].Background)
@@ -115,18 +279,15 @@ func (p *Powerline) PrintSegments() string {
 		// sort parts
 		sort.Sort(Seg.Parts)
 
-		re := regexp.MustCompile("([$&\\\\`!])")
 		for j, Part := range Seg.Parts {
-			// escape dodgy shell injection characters
-			text = Part.Text
-			if Part.Dirty {
-				text = re.ReplaceAllString(Part.Text, "\\$1")
-			}
+			text = escape(Part)
 			// are we on the last part?
 			if (j + 1) == len(Seg.Parts) {
-				buffer.WriteString(fmt.Sprintf("%s%s %s %s%s%s",
+				buffer.WriteString(fmt.Sprintf("%s%s %s ",
 					p.ForegroundColor(Seg.Foreground), p.BackgroundColor(Seg.Background),
-					text,
+					text))
+				lead = buffer.Len()
+				buffer.WriteString(fmt.Sprintf("%s%s%s",
 					nextBackground, p.ForegroundColor(Seg.Background),
 					p.Separator))
 			} else {
@@ -136,42 +297,230 @@ func (p *Powerline) PrintSegments() string {
 					p.BackgroundColor(Seg.Background), p.ForegroundColor(Seg.Foreground), p.SeparatorThin))
 			}
 		}
+		ends[i] = buffer.Len()
 	}
 
 	buffer.WriteString(p.Reset)
 
-	return buffer.String()
+	return buffer.String(), starts, ends
+}
+
+// lineWidths returns the number of cells taken by each line of the prompt
+func (p *Powerline) lineWidths() []int {
+	var widths []int
+	width := 0
+
+	separator, thin := p.Separator, p.SeparatorThin
+	if p.Right {
+		separator, thin = p.SeparatorRight, p.SeparatorRightThin
+	}
+
+	for i, Seg := range p.Segments {
+		if i == 0 || Seg.NewLine {
+			if i > 0 {
+				widths = append(widths, width)
+			}
+			width = TextWidth(p.ConnectorTop)
+			if i > 0 {
+				width = TextWidth(p.ConnectorBottom)
+			}
+		}
+		for j, Part := range Seg.Parts {
+			width += TextWidth(Part.Text) + 2
+			if j > 0 {
+				width += TextWidth(thin)
+			}
+		}
+		width += TextWidth(separator)
+	}
+	return append(widths, width)
+}
+
+func (p *Powerline) Width() int {
+	width := 0
+	for _, w := range p.lineWidths() {
+		if w > width {
+			width = w
+		}
+	}
+	return width
+}
+
+// FitWidth squeezes the prompt into max cells, first by shortening the
+// shrinkable parts (paths, branch names) then by dropping the segments with
+// the lowest weight. Segments marked Keep are never dropped
+func (p *Powerline) FitWidth(max int) {
+	sort.Sort(p.Segments)
+
+	type shrinkable struct {
+		seg, part int
+		text      string
+		length    int
+	}
+	var parts []shrinkable
+	for i, Seg := range p.Segments {
+		for j, Part := range Seg.Parts {
+			if Part.Shrink {
+				parts = append(parts, shrinkable{i, j, Part.Text, TextWidth(Part.Text)})
+			}
+		}
+	}
+
+	// shorten the longest shrinkable part one cell at a time
+	minLength := TextWidth(p.Ellipsis) + 2
+	for p.Width() > max {
+		longest := -1
+		for i := range parts {
+			if parts[i].length > minLength && (longest < 0 || parts[i].length > parts[longest].length) {
+				longest = i
+			}
+		}
+		if longest < 0 {
+			break
+		}
+		part := &parts[longest]
+		part.length--
+		p.Segments[part.seg].Parts[part.part].Text = Shorten(part.text, part.length, p.Ellipsis)
+	}
+
+	// still too wide, drop the right most of the lowest weighted segments
+	for p.Width() > max {
+		drop := -1
+		for i, Seg := range p.Segments {
+			if !Seg.Keep && (drop < 0 || Seg.Weight <= p.Segments[drop].Weight) {
+				drop = i
+			}
+		}
+		if drop < 0 {
+			break
+		}
+		p.Segments = append(p.Segments[:drop], p.Segments[drop+1:]...)
+	}
+}
+
+// printRightSegments renders the segments for the right hand side of the
+// terminal, separators point left and each segment starts with a transition
+// from the previous background
+func (p *Powerline) printRightSegments() string {
+	if len(p.Segments) == 0 {
+		return ""
+	}
+	text, _, _ := p.renderRightSegments()
+	return text
+}
+
+// renderRightSegments draws the right prompt, along with where each
+// segment's span starts and ends. A segment's separator is drawn before it,
+// so its span runs on over the next one's
+func (p *Powerline) renderRightSegments() (string, []int, []int) {
+	var buffer bytes.Buffer
+	starts := make([]int, len(p.Segments))
+	ends := make([]int, len(p.Segments))
+
+	if len(p.Segments) == 0 {
+		return "", starts, ends
+	}
+
+	// bash has no RPROMPT, the whole thing is drawn as a single non-printing
+	// sequence at the end of the line before jumping back to the start
+	if p.Shell == "bash" && p.Depth != NoColour {
+		shTemplate, reset := p.ShTemplate, p.Reset
+		p.ShTemplate, p.Reset = "\\e%s", "\\e[0m"
+		defer func() {
+			p.ShTemplate, p.Reset = shTemplate, reset
+		}()
+	}
+
+	sort.Sort(p.Segments)
+
+	escape := p.escapeText()
+	width := 0
+	prevBackground := p.Reset
+
+	for i, Seg := range p.Segments {
+		sort.Sort(Seg.Parts)
+
+		starts[i] = buffer.Len()
+		buffer.WriteString(fmt.Sprintf("%s%s%s", prevBackground, p.ForegroundColor(Seg.Background), p.SeparatorRight))
+		width += TextWidth(p.SeparatorRight)
+		if i > 0 {
+			ends[i-1] = buffer.Len()
+		}
+
+		for j, Part := range Seg.Parts {
+			if j > 0 {
+				buffer.WriteString(p.SeparatorRightThin)
+				width += TextWidth(p.SeparatorRightThin)
+			}
+			buffer.WriteString(fmt.Sprintf("%s%s %s ",
+				p.ForegroundColor(Seg.Foreground), p.BackgroundColor(Seg.Background),
+				escape(Part)))
+			width += TextWidth(Part.Text) + 2
+		}
+
+		prevBackground = p.BackgroundColor(Seg.Background)
+	}
+	ends[len(p.Segments)-1] = buffer.Len()
+
+	buffer.WriteString(p.Reset)
+
+	if p.Shell == "bash" {
+		prefix := fmt.Sprintf("\\[\\e7\\e[999C\\e[%dD", width-1)
+		for i := range starts {
+			starts[i] += len(prefix)
+			ends[i] += len(prefix)
+		}
+		return prefix + buffer.String() + "\\e8\\]", starts, ends
+	}
+	return buffer.String(), starts, ends
 }
 
 func NewPowerline(shell string, fancy bool) Powerline {
 	p := Powerline{
-		ReadOnly:      "\u2297",
-		Separator:     "",
-		SeparatorThin: "/",
-		Ellipsis:      "\u2026",
-		Branch:        "\u2607",
-		Phases:        "+",
-		Added:         "\u2714",
-		Modified:      "\u270e",
-		Untracked:     "\u2690",
-		Removed:       "\u2716",
-		Renamed:       "\u2608",
-		Detached:      "\u2702",
-		Ahead:         "\u21d1",
-		Behind:        "\u21d3",
-		Conflicted:    "\u203c",
+		Shell:              shell,
+		Depth:              Colours256,
+		ReadOnly:           "\u2297",
+		Separator:          "",
+		SeparatorThin:      "/",
+		SeparatorRight:     "",
+		SeparatorRightThin: "/",
+		Ellipsis:           "\u2026",
+		Branch:             "\u2607",
+		Phases:             "+",
+		Added:              "\u2714",
+		Modified:           "\u270e",
+		Untracked:          "\u2690",
+		Removed:            "\u2716",
+		Renamed:            "\u2608",
+		Detached:           "\u2702",
+		Ahead:              "\u21d1",
+		Behind:             "\u21d3",
+		Conflicted:         "\u203c",
+		Operation:          "\u21bb",
+		Pending:            "\u22ef",
+		Stale:              "?",
+		Stashed:            "\u2691",
+		StagedModified:     "\u270f",
+		StagedRemoved:      "\u2718",
+		Submodule:          "\u29c9",
+		Worktree:           "\u22d4",
+		GitDir:             "\u2699",
 	}
 
 	if fancy {
 		p.Separator = "\ue0b0"
 		p.SeparatorThin = "\ue0b1"
+		p.SeparatorRight = "\ue0b2"
+		p.SeparatorRightThin = "\ue0b3"
 		p.Branch = "\ue0a0"
 	}
 
 	switch shell {
 	case "bash":
 		p.ShTemplate = "\\[\\e%s\\]"
-		p.ColorTemplate = "[%03d;5;%03dm"
+		p.ColorTemplate = "[%sm"
+		p.Escape = "([$&\\\\`!])"
+		p.EscapeWith = "\\$1"
 		p.Reset = "\\[\\e[0m\\]"
 		p.Bold = "\\[\\e[1m\\]"
 		p.Dollar = "\\$"
@@ -180,12 +529,40 @@ func NewPowerline(shell string, fancy bool) Powerline {
 	case "zsh":
 		p.ShTemplate = "%s"
 		// escape literal %'s (%%) as this gets passed through ShTemplate afterwards
-		p.ColorTemplate = "%%{[%d;5;%dm%%}"
+		p.ColorTemplate = "%%{[%sm%%}"
+		p.Escape = "([$&\\\\`!])"
+		p.EscapeWith = "\\$1"
 		// p.ColorTemplate = "%%{%%k{%d}%%f{%d}%%}"
 		p.Reset = "%{%k%f%}"
 		p.Bold = "%{[1m%}"
 		p.Dollar = "%#"
 		p.SetTitle = "%{\033]0;%n@%m: %~\007%}"
+
+	case "fish":
+		// fish prints the prompt verbatim, nothing needs wrapping or escaping
+		p.ShTemplate = "%s"
+		p.ColorTemplate = "\033[%sm"
+		p.Reset = "\033[0m"
+		p.Bold = "\033[1m"
+		p.Dollar = "$"
+		// fish manages the title itself via fish_title
+		p.SetTitle = ""
+
+	case "ansi":
+		// raw escapes for scripts, no prompt character or title
+		p.ShTemplate = "%s"
+		p.ColorTemplate = "\033[%sm"
+		p.Reset = "\033[0m"
+		p.Bold = "\033[1m"
+
+	case "tmux":
+		// status-left/status-right format, a literal # has to be doubled
+		p.ShTemplate = "%s"
+		p.ColorTemplate = "#[%s]"
+		p.Escape = "(#)"
+		p.EscapeWith = "#$1"
+		p.Reset = "#[default]"
+		p.Bold = "#[bold]"
 	}
 	return p
 }
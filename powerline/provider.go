@@ -0,0 +1,125 @@
+package powerline
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// SegmentProvider builds the segments for one part of the prompt. The name
+// is what rightSegments and the --segments and --pending options refer to
+type SegmentProvider interface {
+	Name() string
+	// Enabled is asked first, so a disabled provider costs nothing
+	Enabled(ctx *Context) bool
+	// Build runs concurrently with the other providers and should give up
+	// once ctx.Ctx is done, whatever isn't ready by then is left out
+	Build(ctx *Context) []Segment
+}
+
+// Repository is the version controlled directory the prompt is in
+type Repository struct {
+	Kind string // "git", "hg" or "svn"
+	Root string // top of the work tree, or the git dir when there isn't one
+}
+
+// Context is shared by the providers building one prompt, it mustn't be
+// changed by them
+type Context struct {
+	Ctx context.Context
+	// always a config.Configuration, which can't be named here as the
+	// config package depends on this one: ctx.Config.(config.Configuration)
+	Config     interface{}
+	RawConfig  []byte
+	Cwd        string
+	Repository *Repository // nil outside of a repository
+	LookupEnv  func(key string) (string, bool)
+	Powerline  *Powerline // the shell and icons
+	Right      bool
+
+	// what the shell told us about the last command
+	ReturnCode int
+	PipeStatus []int
+	Duration   time.Duration
+}
+
+// Option decodes the top level configuration key name into v, so providers
+// can have options of their own. v is left alone when it isn't set
+func (ctx *Context) Option(name string, v interface{}) error {
+	if len(ctx.RawConfig) == 0 {
+		return nil
+	}
+	var options map[string]json.RawMessage
+	if err := json.Unmarshal(ctx.RawConfig, &options); err != nil {
+		return err
+	}
+	if option, found := options[name]; found {
+		return json.Unmarshal(option, v)
+	}
+	return nil
+}
+
+type funcProvider struct {
+	name    string
+	enabled func(ctx *Context) bool
+	build   func(ctx *Context) []Segment
+}
+
+func (f funcProvider) Name() string {
+	return f.name
+}
+
+func (f funcProvider) Enabled(ctx *Context) bool {
+	return f.enabled == nil || f.enabled(ctx)
+}
+
+func (f funcProvider) Build(ctx *Context) []Segment {
+	return f.build(ctx)
+}
+
+// NewProvider makes a provider out of functions, a nil enabled means always
+func NewProvider(name string, enabled func(ctx *Context) bool, build func(ctx *Context) []Segment) SegmentProvider {
+	return funcProvider{name, enabled, build}
+}
+
+var registry struct {
+	sync.Mutex
+	providers []SegmentProvider
+}
+
+// Register adds a provider to the prompt, usually from an init function.
+// Registering a name again replaces the earlier provider in its place, which
+// is how a built in segment is swapped for another
+func Register(provider SegmentProvider) {
+	registry.Lock()
+	defer registry.Unlock()
+	for i, registered := range registry.providers {
+		if registered.Name() == provider.Name() {
+			registry.providers[i] = provider
+			return
+		}
+	}
+	registry.providers = append(registry.providers, provider)
+}
+
+// Unregister removes the named provider, e.g. a built in segment that isn't
+// wanted at all
+func Unregister(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	for i, registered := range registry.providers {
+		if registered.Name() == name {
+			registry.providers = append(registry.providers[:i], registry.providers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Providers lists the registered providers in the order they were added,
+// which is the order segments of equal weight appear in
+func Providers() []SegmentProvider {
+	registry.Lock()
+	defer registry.Unlock()
+	return append([]SegmentProvider(nil), registry.providers...)
+}
@@ -0,0 +1,154 @@
+package powerline
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// East Asian Wide and Fullwidth ranges plus the emoji that terminals draw two
+// cells wide
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x231a, 0x231b}, {0x2329, 0x232a}, {0x23e9, 0x23ec},
+	{0x23f0, 0x23f0}, {0x23f3, 0x23f3}, {0x25fd, 0x25fe}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267f, 0x267f}, {0x2693, 0x2693}, {0x26a1, 0x26a1},
+	{0x26aa, 0x26ab}, {0x26bd, 0x26be}, {0x26c4, 0x26c5}, {0x26ce, 0x26ce},
+	{0x26d4, 0x26d4}, {0x26ea, 0x26ea}, {0x26f2, 0x26f3}, {0x26f5, 0x26f5},
+	{0x26fa, 0x26fa}, {0x26fd, 0x26fd}, {0x2705, 0x2705}, {0x270a, 0x270b},
+	{0x2728, 0x2728}, {0x274c, 0x274c}, {0x274e, 0x274e}, {0x2753, 0x2755},
+	{0x2757, 0x2757}, {0x2795, 0x2797}, {0x27b0, 0x27b0}, {0x27bf, 0x27bf},
+	{0x2b1b, 0x2b1c}, {0x2b50, 0x2b50}, {0x2b55, 0x2b55}, {0x2e80, 0x303e},
+	{0x3041, 0x33ff}, {0x3400, 0x4dbf}, {0x4e00, 0x9fff}, {0xa000, 0xa4cf},
+	{0xa960, 0xa97f}, {0xac00, 0xd7a3}, {0xf900, 0xfaff}, {0xfe10, 0xfe19},
+	{0xfe30, 0xfe6f}, {0xff00, 0xff60}, {0xffe0, 0xffe6}, {0x16fe0, 0x16fe4},
+	{0x17000, 0x18aff}, {0x1b000, 0x1b2ff}, {0x1f004, 0x1f004}, {0x1f0cf, 0x1f0cf},
+	{0x1f18e, 0x1f18e}, {0x1f191, 0x1f19a}, {0x1f200, 0x1f251}, {0x1f300, 0x1f64f},
+	{0x1f680, 0x1f6ff}, {0x1f7e0, 0x1f7eb}, {0x1f90c, 0x1f9ff}, {0x1fa70, 0x1faff},
+	{0x20000, 0x2fffd}, {0x30000, 0x3fffd},
+}
+
+func isWide(r rune) bool {
+	i := sort.Search(len(wideRanges), func(i int) bool { return wideRanges[i][1] >= r })
+	return i < len(wideRanges) && wideRanges[i][0] <= r
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// extends reports whether r belongs to the same grapheme as the rune before it
+func extends(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		r == 0x200d || // zero width joiner
+		(r >= 0xfe00 && r <= 0xfe0f) || // variation selectors
+		(r >= 0x1f3fb && r <= 0x1f3ff) || // skin tones
+		(r >= 0xe0020 && r <= 0xe007f) // tags
+}
+
+// graphemes splits s into user-perceived characters. It covers combining
+// marks, emoji ZWJ sequences, modifiers and flags rather than the whole of
+// UAX #29
+func graphemes(s string) []string {
+	var clusters []string
+	start := 0
+	var prev rune = -1
+	pairedRI := false
+
+	for i, r := range s {
+		join := i > 0 && (extends(r) || prev == 0x200d)
+		if i > 0 && !join && isRegionalIndicator(r) && isRegionalIndicator(prev) && !pairedRI {
+			join = true
+			pairedRI = true
+		} else if !join {
+			pairedRI = false
+		}
+		if i > 0 && !join {
+			clusters = append(clusters, s[start:i])
+			start = i
+		}
+		prev = r
+	}
+	if start < len(s) {
+		clusters = append(clusters, s[start:])
+	}
+	return clusters
+}
+
+func graphemeWidth(g string) int {
+	r, _ := utf8.DecodeRuneInString(g)
+	switch {
+	case unicode.IsControl(r) || extends(r):
+		return 0
+	case isWide(r) || isRegionalIndicator(r):
+		return 2
+	case strings.ContainsRune(g, 0xfe0f):
+		// emoji presentation selector
+		return 2
+	}
+	return 1
+}
+
+// TextWidth is the number of terminal cells taken up by s
+func TextWidth(s string) int {
+	width := 0
+	for _, g := range graphemes(s) {
+		width += graphemeWidth(g)
+	}
+	return width
+}
+
+// headWidth returns the longest run of whole graphemes from the start of
+// clusters that fits into width cells, tailWidth does the same from the end
+func headWidth(clusters []string, width int) string {
+	var buffer strings.Builder
+	for _, g := range clusters {
+		width -= graphemeWidth(g)
+		if width < 0 {
+			break
+		}
+		buffer.WriteString(g)
+	}
+	return buffer.String()
+}
+
+func tailWidth(clusters []string, width int) string {
+	i := len(clusters)
+	for i > 0 {
+		width -= graphemeWidth(clusters[i-1])
+		if width < 0 {
+			break
+		}
+		i--
+	}
+	return strings.Join(clusters[i:], "")
+}
+
+// Truncate shortens s when it is wider than max cells by keeping max/2-1
+// cells from either end joined by the ellipsis
+func Truncate(s string, max int, ellipsis string) string {
+	if TextWidth(s) <= max {
+		return s
+	}
+	sml := max/2 - 1
+	if sml <= 0 {
+		return s
+	}
+	clusters := graphemes(s)
+	return headWidth(clusters, sml) + ellipsis + tailWidth(clusters, sml)
+}
+
+// Shorten cuts the middle out of s so it fits into width cells, ellipsis
+// included
+func Shorten(s string, width int, ellipsis string) string {
+	if TextWidth(s) <= width {
+		return s
+	}
+	room := width - TextWidth(ellipsis)
+	if room < 2 {
+		return s
+	}
+	clusters := graphemes(s)
+	head := (room + 1) / 2
+	return headWidth(clusters, head) + ellipsis + tailWidth(clusters, room-head)
+}
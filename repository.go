@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/scottweston/powerline-shell-go/powerline"
+	"github.com/scottweston/powerline-shell-go/powerline-config"
+)
+
+// repositoryCeilings are the directories discovery won't walk up into, from
+// $GIT_CEILING_DIRECTORIES and the ceilingDirectories option
+func repositoryCeilings(conf config.Configuration) []string {
+	ceilings := gitCeilings()
+	home, _ := os.UserHomeDir()
+	for _, dir := range conf.CeilingDirectories {
+		if strings.HasPrefix(dir, "~/") && home != "" {
+			dir = filepath.Join(home, dir[2:])
+		} else if dir == "~" {
+			dir = home
+		}
+		if filepath.IsAbs(dir) {
+			ceilings = append(ceilings, filepath.Clean(dir))
+		}
+	}
+	return ceilings
+}
+
+// gitCeilings are the directories in $GIT_CEILING_DIRECTORIES, like git
+// relative entries are ignored
+func gitCeilings() []string {
+	var ceilings []string
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_CEILING_DIRECTORIES")) {
+		if filepath.IsAbs(dir) {
+			ceilings = append(ceilings, filepath.Clean(dir))
+		}
+	}
+	return ceilings
+}
+
+// discoverRepository walks up from dir to the closest .git, .hg or .svn,
+// stopping short of the ceilings. It's found once up front so only the
+// matching VCS segment does any work. dir itself is always looked at. $GIT_DIR
+// overrides the search as it does for git
+func discoverRepository(dir string, ceilings []string) *powerline.Repository {
+	if os.Getenv("GIT_DIR") != "" {
+		root := os.Getenv("GIT_WORK_TREE")
+		if root == "" {
+			root = dir
+		}
+		return &powerline.Repository{Kind: "git", Root: root}
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	for {
+		// inside a bare repository or the .git dir itself
+		if isGitDir(dir) {
+			return &powerline.Repository{Kind: "git", Root: dir}
+		}
+		// .git is a file in worktrees and submodules
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return &powerline.Repository{Kind: "git", Root: dir}
+		}
+		if info, err := os.Stat(filepath.Join(dir, ".hg")); err == nil && info.IsDir() {
+			return &powerline.Repository{Kind: "hg", Root: dir}
+		}
+		if info, err := os.Stat(filepath.Join(dir, ".svn")); err == nil && info.IsDir() {
+			return &powerline.Repository{Kind: "svn", Root: dir}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir || isCeiling(parent, ceilings) {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+func isCeiling(dir string, ceilings []string) bool {
+	for _, ceiling := range ceilings {
+		if dir == ceiling {
+			return true
+		}
+	}
+	return false
+}
+
+// repoRelativeParts splits cwd for the cwd segment starting at the name of
+// the repository rather than / or ~
+func repoRelativeParts(cwd string, root string) []string {
+	rel, err := filepath.Rel(root, cwd)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	parts := []string{filepath.Base(root)}
+	if rel != "." {
+		parts = append(parts, strings.Split(rel, string(filepath.Separator))...)
+	}
+	return parts
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/scottweston/powerline-shell-go/powerline"
+	"github.com/scottweston/powerline-shell-go/powerline-config"
+)
+
+// segmentProvider builds the segments for one part of the prompt, it should
+// give up once ctx is done
+type segmentProvider struct {
+	name  string
+	build func(ctx context.Context) []powerline.Segment
+}
+
+// single wraps the segment builders that return at most one segment
+func single(segment *powerline.Segment) []powerline.Segment {
+	if segment == nil {
+		return nil
+	}
+	return []powerline.Segment{*segment}
+}
+
+// configOf is the configuration given to the built in providers
+func configOf(ctx *powerline.Context) config.Configuration {
+	return ctx.Config.(config.Configuration)
+}
+
+// bindProvider runs a registered provider with the context shared by the
+// whole prompt
+func bindProvider(shared *powerline.Context, provider powerline.SegmentProvider) segmentProvider {
+	return segmentProvider{provider.Name(), func(ctx context.Context) []powerline.Segment {
+		return provider.Build(shared)
+	}}
+}
+
+// the built in segments, in the order segments of equal weight are shown
+func init() {
+	powerline.Register(powerline.NewProvider("virtualenv", func(ctx *powerline.Context) bool {
+		return configOf(ctx).ShowVirtualEnv
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		return single(addVirtulEnvName(configOf(ctx), getVirtualEnv()))
+	}))
+	powerline.Register(powerline.NewProvider("hostname", func(ctx *powerline.Context) bool {
+		_, found := ctx.LookupEnv("SSH_CLIENT")
+		return found
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		return single(addHostname(configOf(ctx), true, true, *ctx.Powerline))
+	}))
+	powerline.Register(powerline.NewProvider("cwd", func(ctx *powerline.Context) bool {
+		return configOf(ctx).ShowCwd
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		conf := configOf(ctx)
+		parts := splitCwd(ctx.Cwd)
+		if ctx.Repository != nil && conf.CwdRelativeToRepo {
+			if relative := repoRelativeParts(ctx.Cwd, ctx.Repository.Root); relative != nil {
+				parts = relative
+			}
+		}
+		return addCwd(conf, parts, *ctx.Powerline)
+	}))
+	powerline.Register(powerline.NewProvider("lock", func(ctx *powerline.Context) bool {
+		return configOf(ctx).ShowWritable
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		return single(addLock(configOf(ctx), ctx.Cwd, *ctx.Powerline))
+	}))
+	powerline.Register(powerline.NewProvider("git", func(ctx *powerline.Context) bool {
+		return configOf(ctx).ShowGit && ctx.Repository != nil && ctx.Repository.Kind == "git"
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		conf := configOf(ctx)
+		if cached, err := askDaemon(conf, ctx.Repository); err == nil {
+			return single(addGitInfo(conf, *cached.Git, *ctx.Powerline))
+		}
+		probe, cancel := vcsContext(ctx.Ctx, conf)
+		defer cancel()
+		status, err := readGitStatus(probe, conf, ctx.Cwd)
+		if err != nil {
+			return nil
+		}
+		return single(addGitInfo(conf, status, *ctx.Powerline))
+	}))
+	powerline.Register(powerline.NewProvider("hg", func(ctx *powerline.Context) bool {
+		return configOf(ctx).ShowHg && ctx.Repository != nil && ctx.Repository.Kind == "hg"
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		conf := configOf(ctx)
+		if cached, err := askDaemon(conf, ctx.Repository); err == nil {
+			return single(addHgInfo(conf, cached.Hg, false, *ctx.Powerline))
+		}
+		probe, cancel := vcsContext(ctx.Ctx, conf)
+		defer cancel()
+		return single(addHgInfo(conf, readHgSummary(probe, ctx.Cwd), probe.Err() != nil, *ctx.Powerline))
+	}))
+	powerline.Register(powerline.NewProvider("returncode", func(ctx *powerline.Context) bool {
+		return configOf(ctx).ShowReturnCode
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		if len(ctx.PipeStatus) > 1 {
+			return single(addPipeStatus(configOf(ctx), ctx.PipeStatus))
+		}
+		return single(addReturnCode(configOf(ctx), ctx.ReturnCode))
+	}))
+	powerline.Register(powerline.NewProvider("duration", func(ctx *powerline.Context) bool {
+		return configOf(ctx).ShowDuration
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		return single(addDuration(configOf(ctx), ctx.Duration))
+	}))
+	powerline.Register(powerline.NewProvider("battery", func(ctx *powerline.Context) bool {
+		return configOf(ctx).BatteryWarn > 0
+	}, func(ctx *powerline.Context) []powerline.Segment {
+		return single(addBatteryWarn(configOf(ctx)))
+	}))
+}
+
+// selectProviders swaps the providers named in pending for placeholder, so
+// the prompt keeps its shape until they're ready
+func selectProviders(providers []segmentProvider, pending []string, placeholder func(name string) []powerline.Segment) []segmentProvider {
+	listed := func(names []string, name string) bool {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	var selected []segmentProvider
+	for _, provider := range providers {
+		if listed(pending, provider.name) {
+			name := provider.name
+			provider.build = func(ctx context.Context) []powerline.Segment {
+				return placeholder(name)
+			}
+		}
+		selected = append(selected, provider)
+	}
+	return selected
+}
+
+// evaluateSegments runs the providers concurrently. Their segments are
+// collected in provider order and then by weight, so the result doesn't
+// depend on which finishes first. Providers still running when ctx is done
+// are skipped
+func evaluateSegments(ctx context.Context, providers []segmentProvider) []powerline.Segment {
+	type result struct {
+		index    int
+		segments []powerline.Segment
+	}
+	// buffered so late providers can finish without anyone listening
+	results := make(chan result, len(providers))
+	for i, provider := range providers {
+		go func(i int, provider segmentProvider) {
+			segments := provider.build(ctx)
+			for j := range segments {
+				segments[j].Provider = provider.name
+			}
+			results <- result{i, segments}
+		}(i, provider)
+	}
+
+	collected := make([][]powerline.Segment, len(providers))
+collect:
+	for remaining := len(providers); remaining > 0; remaining-- {
+		select {
+		case r := <-results:
+			collected[r.index] = r.segments
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	var segments []powerline.Segment
+	for _, s := range collected {
+		segments = append(segments, s...)
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].Weight > segments[j].Weight
+	})
+	return segments
+}
+
+// promptContext is the deadline for the whole prompt, promptTimeout is in
+// seconds
+func promptContext(conf config.Configuration) (context.Context, context.CancelFunc) {
+	if conf.PromptTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(conf.PromptTimeout*float64(time.Second)))
+}
@@ -0,0 +1,16 @@
+// +build linux darwin
+
+package main
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SignalName returns the short name of a signal, e.g. "INT" for 2, or an
+// empty string when it isn't known
+func SignalName(sig int) string {
+	return strings.TrimPrefix(unix.SignalName(syscall.Signal(sig)), "SIG")
+}
@@ -0,0 +1,5 @@
+package main
+
+func SignalName(sig int) string {
+	return ""
+}
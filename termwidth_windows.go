@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+func TerminalWidth() int {
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 0
+}